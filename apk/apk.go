@@ -0,0 +1,139 @@
+// Package apk reads the information the build needs from APK files.
+package apk
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Resource IDs of the manifest attributes that are read. Attribute names can
+// be stripped by obfuscators, the IDs cannot.
+const (
+	attrName          = 0x01010003
+	attrVersionCode   = 0x0101021b
+	attrVersionName   = 0x0101021c
+	attrMinSdkVersion = 0x0101020c
+	attrTargetSdk     = 0x01010270
+)
+
+// Info is what an APK says about itself
+type Info struct {
+	PackageName string
+	VersionName string
+	VersionCode int
+	MinSdk      int
+	TargetSdk   int
+	Permissions []string
+	NativeABIs  []string
+}
+
+func findAttr(elem xmlElement, resId uint32, name string) (xmlAttr, bool) {
+	for _, attr := range elem.Attrs {
+		if attr.ResId == resId && resId != 0 {
+			return attr, true
+		}
+	}
+	for _, attr := range elem.Attrs {
+		if attr.Name == name {
+			return attr, true
+		}
+	}
+	return xmlAttr{}, false
+}
+
+// ParseManifest decodes a binary AndroidManifest.xml
+func ParseManifest(data []byte) (*Info, error) {
+	elems, err := parseAXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error while decoding AndroidManifest.xml:\n  %v", err)
+	}
+	if len(elems) == 0 || elems[0].Name != "manifest" {
+		return nil, fmt.Errorf("AndroidManifest.xml has no <manifest> element")
+	}
+
+	// A missing minSdkVersion means the app runs on every version
+	info := &Info{MinSdk: 1}
+	manifest := elems[0]
+	if attr, ok := findAttr(manifest, 0, "package"); ok {
+		info.PackageName = attr.String()
+	}
+	if attr, ok := findAttr(manifest, attrVersionCode, "versionCode"); ok {
+		info.VersionCode, _ = attr.Int()
+	}
+	if attr, ok := findAttr(manifest, attrVersionName, "versionName"); ok {
+		info.VersionName = attr.String()
+	}
+
+	for _, elem := range elems[1:] {
+		if elem.Depth != 2 {
+			continue
+		}
+		switch elem.Name {
+		case "uses-sdk":
+			// Preview SDKs use a codename instead of a number
+			if attr, ok := findAttr(elem, attrMinSdkVersion, "minSdkVersion"); ok {
+				if sdk, ok := attr.Int(); ok {
+					info.MinSdk = sdk
+				}
+			}
+			if attr, ok := findAttr(elem, attrTargetSdk, "targetSdkVersion"); ok {
+				info.TargetSdk, _ = attr.Int()
+			}
+		case "uses-permission", "uses-permission-sdk-23", "uses-permission-sdk-m":
+			if attr, ok := findAttr(elem, attrName, "name"); ok && attr.String() != "" {
+				info.Permissions = append(info.Permissions, attr.String())
+			}
+		}
+	}
+
+	if info.PackageName == "" {
+		return nil, fmt.Errorf("AndroidManifest.xml does not declare a package name")
+	}
+	return info, nil
+}
+
+// Inspect reads the manifest and native libraries of the APK at path
+func Inspect(path string) (*Info, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening the apk at %v:\n  %v", path, err)
+	}
+	defer reader.Close()
+
+	var info *Info
+	abis := make(map[string]bool)
+	for _, file := range reader.File {
+		if file.Name == "AndroidManifest.xml" {
+			rc, err := file.Open()
+			if err != nil {
+				return nil, fmt.Errorf("Error while opening AndroidManifest.xml in %v:\n  %v", path, err)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Error while reading AndroidManifest.xml in %v:\n  %v", path, err)
+			}
+			info, err = ParseManifest(data)
+			if err != nil {
+				return nil, fmt.Errorf("Error while reading %v:\n  %v", path, err)
+			}
+		} else if strings.HasPrefix(file.Name, "lib/") && strings.HasSuffix(file.Name, ".so") {
+			parts := strings.Split(file.Name, "/")
+			if len(parts) == 3 {
+				abis[parts[1]] = true
+			}
+		}
+	}
+
+	if info == nil {
+		return nil, fmt.Errorf("%v does not contain an AndroidManifest.xml", path)
+	}
+	for abi := range abis {
+		info.NativeABIs = append(info.NativeABIs, abi)
+	}
+	sort.Strings(info.NativeABIs)
+	return info, nil
+}
@@ -0,0 +1,323 @@
+package apk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Android compiles XML resources such as AndroidManifest.xml into a binary
+// format (AXML): a sequence of chunks, starting with a string pool, that
+// describe the elements of the document. Only what is needed to read
+// manifests is decoded here.
+
+const (
+	chunkStringPool   = 0x0001
+	chunkXML          = 0x0003
+	chunkStartElement = 0x0102
+	chunkEndElement   = 0x0103
+	chunkResourceMap  = 0x0180
+
+	stringPoolUTF8 = 1 << 8
+	noEntry        = 0xffffffff
+
+	typeReference = 0x01
+	typeString    = 0x03
+	typeIntDec    = 0x10
+	typeIntHex    = 0x11
+	typeBoolean   = 0x12
+)
+
+type xmlAttr struct {
+	Namespace string
+	Name      string
+	ResId     uint32 // Android resource ID of the attribute name, 0 if unknown
+	Type      uint8
+	Data      uint32
+	Str       string // Set for string values
+}
+
+// Int returns the integer value of the attribute, parsing strings if needed
+func (a xmlAttr) Int() (int, bool) {
+	switch a.Type {
+	case typeIntDec, typeIntHex:
+		return int(int32(a.Data)), true
+	case typeString:
+		i, err := strconv.Atoi(a.Str)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// String returns the attribute value as text. References to resources cannot
+// be resolved without resources.arsc and are returned as "@0x...".
+func (a xmlAttr) String() string {
+	switch a.Type {
+	case typeString:
+		return a.Str
+	case typeReference:
+		return fmt.Sprintf("@0x%08x", a.Data)
+	case typeBoolean:
+		return strconv.FormatBool(a.Data != 0)
+	case typeIntHex:
+		return fmt.Sprintf("0x%x", a.Data)
+	}
+	if i, ok := a.Int(); ok {
+		return strconv.Itoa(i)
+	}
+	return a.Str
+}
+
+type xmlElement struct {
+	Name  string
+	Depth int
+	Attrs []xmlAttr
+}
+
+type axmlParser struct {
+	data    []byte
+	strings []string
+	resIds  []uint32
+}
+
+func (p *axmlParser) u16(off int) (uint16, error) {
+	if off < 0 || off+2 > len(p.data) {
+		return 0, fmt.Errorf("Unexpected end of binary XML at offset %v", off)
+	}
+	return binary.LittleEndian.Uint16(p.data[off:]), nil
+}
+
+func (p *axmlParser) u32(off int) (uint32, error) {
+	if off < 0 || off+4 > len(p.data) {
+		return 0, fmt.Errorf("Unexpected end of binary XML at offset %v", off)
+	}
+	return binary.LittleEndian.Uint32(p.data[off:]), nil
+}
+
+func (p *axmlParser) str(index uint32) string {
+	if index == noEntry || int(index) >= len(p.strings) {
+		return ""
+	}
+	return p.strings[index]
+}
+
+func (p *axmlParser) parseStringPool(chunk, headerSize, size int) error {
+	count, err := p.u32(chunk + 8)
+	if err != nil {
+		return err
+	}
+	flags, err := p.u32(chunk + 16)
+	if err != nil {
+		return err
+	}
+	start, err := p.u32(chunk + 20)
+	if err != nil {
+		return err
+	}
+	if int(count) > size/4 {
+		return fmt.Errorf("String pool claims %v strings but is only %v bytes", count, size)
+	}
+
+	p.strings = make([]string, count)
+	for i := 0; i < int(count); i++ {
+		offset, err := p.u32(chunk + headerSize + i*4)
+		if err != nil {
+			return err
+		}
+		pos := chunk + int(start) + int(offset)
+		if flags&stringPoolUTF8 != 0 {
+			p.strings[i], err = p.utf8String(pos)
+		} else {
+			p.strings[i], err = p.utf16String(pos)
+		}
+		if err != nil {
+			return fmt.Errorf("Error while reading string %v:\n  %v", i, err)
+		}
+	}
+	return nil
+}
+
+// utf8Length reads a length prefix of one or two bytes
+func (p *axmlParser) utf8Length(pos int) (int, int, error) {
+	if pos >= len(p.data) {
+		return 0, 0, fmt.Errorf("Unexpected end of string pool")
+	}
+	length := int(p.data[pos])
+	if length&0x80 == 0 {
+		return length, pos + 1, nil
+	}
+	if pos+1 >= len(p.data) {
+		return 0, 0, fmt.Errorf("Unexpected end of string pool")
+	}
+	return (length&0x7f)<<8 | int(p.data[pos+1]), pos + 2, nil
+}
+
+func (p *axmlParser) utf8String(pos int) (string, error) {
+	// UTF-16 length first, then the length in bytes
+	_, pos, err := p.utf8Length(pos)
+	if err != nil {
+		return "", err
+	}
+	length, pos, err := p.utf8Length(pos)
+	if err != nil {
+		return "", err
+	}
+	if pos+length > len(p.data) {
+		return "", fmt.Errorf("Unexpected end of string pool")
+	}
+	return string(p.data[pos : pos+length]), nil
+}
+
+func (p *axmlParser) utf16String(pos int) (string, error) {
+	first, err := p.u16(pos)
+	if err != nil {
+		return "", err
+	}
+	length := int(first)
+	pos += 2
+	if first&0x8000 != 0 {
+		second, err := p.u16(pos)
+		if err != nil {
+			return "", err
+		}
+		length = int(first&0x7fff)<<16 | int(second)
+		pos += 2
+	}
+	if pos+length*2 > len(p.data) {
+		return "", fmt.Errorf("Unexpected end of string pool")
+	}
+	chars := make([]uint16, length)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(p.data[pos+i*2:])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// parseResourceMap reads the resource IDs of the attribute names, which follow
+// the header of the chunk
+func (p *axmlParser) parseResourceMap(chunk, headerSize, size int) error {
+	p.resIds = make([]uint32, (size-headerSize)/4)
+	for i := range p.resIds {
+		id, err := p.u32(chunk + headerSize + i*4)
+		if err != nil {
+			return fmt.Errorf("Error while reading resource map:\n  %v", err)
+		}
+		p.resIds[i] = id
+	}
+	return nil
+}
+
+func (p *axmlParser) parseStartElement(chunk, headerSize int) (xmlElement, error) {
+	ext := chunk + headerSize
+	name, err := p.u32(ext + 4)
+	if err != nil {
+		return xmlElement{}, err
+	}
+	attrStart, err := p.u16(ext + 8)
+	if err != nil {
+		return xmlElement{}, err
+	}
+	attrSize, err := p.u16(ext + 10)
+	if err != nil {
+		return xmlElement{}, err
+	}
+	attrCount, err := p.u16(ext + 12)
+	if err != nil {
+		return xmlElement{}, err
+	}
+	if attrSize < 20 {
+		attrSize = 20
+	}
+
+	elem := xmlElement{Name: p.str(name)}
+	for i := 0; i < int(attrCount); i++ {
+		pos := ext + int(attrStart) + i*int(attrSize)
+		ns, err := p.u32(pos)
+		if err != nil {
+			return elem, err
+		}
+		attrName, err := p.u32(pos + 4)
+		if err != nil {
+			return elem, err
+		}
+		raw, err := p.u32(pos + 8)
+		if err != nil {
+			return elem, err
+		}
+		if pos+20 > len(p.data) {
+			return elem, fmt.Errorf("Unexpected end of binary XML at offset %v", pos)
+		}
+		attr := xmlAttr{
+			Namespace: p.str(ns),
+			Name:      p.str(attrName),
+			Type:      p.data[pos+15],
+			Data:      binary.LittleEndian.Uint32(p.data[pos+16:])}
+		if int(attrName) < len(p.resIds) {
+			attr.ResId = p.resIds[attrName]
+		}
+		if attr.Type == typeString {
+			attr.Str = p.str(attr.Data)
+		} else if raw != noEntry {
+			attr.Str = p.str(raw)
+		}
+		elem.Attrs = append(elem.Attrs, attr)
+	}
+	return elem, nil
+}
+
+// parseAXML returns every element of a binary XML document in document
+// order, with its depth in the tree (1 for the root element)
+func parseAXML(data []byte) ([]xmlElement, error) {
+	p := &axmlParser{data: data}
+	kind, err := p.u16(0)
+	if err != nil {
+		return nil, err
+	}
+	if kind != chunkXML {
+		return nil, fmt.Errorf("Not a binary XML file")
+	}
+	first, err := p.u16(2)
+	if err != nil {
+		return nil, err
+	}
+
+	var elems []xmlElement
+	depth := 0
+	for pos := int(first); pos+8 <= len(data); {
+		kind, _ := p.u16(pos)
+		headerSize, _ := p.u16(pos + 2)
+		size, _ := p.u32(pos + 4)
+		if size < 8 || pos+int(size) > len(data) {
+			return nil, fmt.Errorf("Invalid chunk of size %v at offset %v", size, pos)
+		}
+		if headerSize < 8 || uint32(headerSize) > size {
+			return nil, fmt.Errorf("Invalid chunk header size %v at offset %v", headerSize, pos)
+		}
+
+		switch kind {
+		case chunkStringPool:
+			err = p.parseStringPool(pos, int(headerSize), int(size))
+			if err != nil {
+				return nil, err
+			}
+		case chunkResourceMap:
+			err = p.parseResourceMap(pos, int(headerSize), int(size))
+			if err != nil {
+				return nil, err
+			}
+		case chunkStartElement:
+			depth++
+			elem, err := p.parseStartElement(pos, int(headerSize))
+			if err != nil {
+				return nil, err
+			}
+			elem.Depth = depth
+			elems = append(elems, elem)
+		case chunkEndElement:
+			depth--
+		}
+		pos += int(size)
+	}
+	return elems, nil
+}
@@ -0,0 +1,119 @@
+package apk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// axmlChunk builds a chunk with the given header fields after type, header
+// size and size, followed by body
+func axmlChunk(kind uint16, header, body []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, kind)
+	binary.Write(&buf, binary.LittleEndian, uint16(8+len(header)))
+	binary.Write(&buf, binary.LittleEndian, uint32(8+len(header)+len(body)))
+	buf.Write(header)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func le(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// axmlStringPool builds a UTF-8 string pool of short strings
+func axmlStringPool(strs ...string) []byte {
+	var offsets, data bytes.Buffer
+	for _, s := range strs {
+		offsets.Write(le(uint32(data.Len())))
+		data.Write([]byte{byte(len(s)), byte(len(s))})
+		data.WriteString(s)
+		data.WriteByte(0)
+	}
+	header := le(uint32(len(strs)), uint32(0), uint32(stringPoolUTF8), uint32(28+offsets.Len()), uint32(0))
+	return axmlChunk(chunkStringPool, header, append(offsets.Bytes(), data.Bytes()...))
+}
+
+// axmlStartElement builds a start element with one string attribute
+func axmlStartElement(name, attrName, value uint32) []byte {
+	ext := le(uint32(noEntry), name, uint16(20), uint16(20), uint16(1), uint16(0), uint16(0), uint16(0))
+	attr := le(uint32(noEntry), attrName, value, uint16(8), uint8(0), uint8(typeString), value)
+	return axmlChunk(chunkStartElement, le(uint32(1), uint32(noEntry)), append(ext, attr...))
+}
+
+func axmlDocument(chunks ...[]byte) []byte {
+	return axmlChunk(chunkXML, nil, bytes.Join(chunks, nil))
+}
+
+func TestParseAXML(t *testing.T) {
+	pool := axmlStringPool("manifest", "package", "com.example")
+	resMap := axmlChunk(chunkResourceMap, nil, le(uint32(0x01010000), uint32(0x01010001)))
+	elem := axmlStartElement(0, 1, 2)
+	valid := axmlDocument(pool, resMap, elem)
+
+	elems, err := parseAXML(valid)
+	if err != nil {
+		t.Fatalf("parseAXML of a valid document failed: %v", err)
+	}
+	if len(elems) != 1 || elems[0].Name != "manifest" || elems[0].Depth != 1 {
+		t.Fatalf("Unexpected elements %+v", elems)
+	}
+	if attrs := elems[0].Attrs; len(attrs) != 1 || attrs[0].Name != "package" ||
+		attrs[0].String() != "com.example" || attrs[0].ResId != 0x01010001 {
+		t.Fatalf("Unexpected attributes %+v", attrs)
+	}
+
+	// A resource map whose header claims to be larger than the chunk
+	badResMap := append([]byte(nil), resMap...)
+	binary.LittleEndian.PutUint16(badResMap[2:], uint16(len(badResMap)+4))
+
+	// A string pool that claims more strings than it has room for
+	badCount := append([]byte(nil), pool...)
+	binary.LittleEndian.PutUint32(badCount[8:], 1000)
+
+	// A string pool whose first string runs past the end of the data
+	badString := append([]byte(nil), pool...)
+	binary.LittleEndian.PutUint32(badString[28:], 0xffff)
+
+	// A start element with more attributes than it contains
+	badAttrs := append([]byte(nil), elem...)
+	binary.LittleEndian.PutUint16(badAttrs[16+12:], 50)
+
+	// A chunk that is smaller than a chunk header
+	tiny := append([]byte(nil), resMap...)
+	binary.LittleEndian.PutUint32(tiny[4:], 4)
+
+	// A chunk whose header is smaller than a chunk header
+	smallHeader := append([]byte(nil), resMap...)
+	binary.LittleEndian.PutUint16(smallHeader[2:], 4)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated document header", valid[:3]},
+		{"not binary XML", axmlChunk(chunkStringPool, nil, nil)},
+		{"truncated chunk", valid[:len(valid)-10]},
+		{"truncated string pool header", axmlDocument(axmlChunk(chunkStringPool, nil, nil))},
+		{"resource map header larger than chunk", axmlDocument(pool, badResMap, elem)},
+		{"chunk smaller than its header", axmlDocument(pool, tiny, elem)},
+		{"header smaller than a chunk header", axmlDocument(pool, smallHeader, elem)},
+		{"string count too large", axmlDocument(badCount, resMap, elem)},
+		{"string past the end", axmlDocument(badString, resMap, elem)},
+		{"attributes past the end", axmlDocument(pool, resMap, badAttrs)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseAXML(test.data)
+			if err == nil {
+				t.Errorf("parseAXML accepted a malformed document")
+			}
+		})
+	}
+}
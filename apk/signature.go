@@ -0,0 +1,475 @@
+package apk
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+)
+
+// APK Signature Scheme v2 and v3 store their signatures in the APK Signing
+// Block, which sits right before the ZIP central directory. Both sign the
+// whole file except the block itself, so unlike v1 they also protect the ZIP
+// metadata. See https://source.android.com/security/apksigning/v2
+const (
+	sigBlockMagic = "APK Sig Block 42"
+	blockIdV2     = 0x7109871a
+	blockIdV3     = 0xf05368c0
+	chunkSize     = 1024 * 1024
+
+	sigRSAPSSSHA256   = 0x0101
+	sigRSAPSSSHA512   = 0x0102
+	sigRSAPKCS1SHA256 = 0x0103
+	sigRSAPKCS1SHA512 = 0x0104
+	sigECDSASHA256    = 0x0201
+	sigECDSASHA512    = 0x0202
+	sigDSASHA256      = 0x0301
+)
+
+// Supported signature algorithms, strongest first. The verity variants are
+// not supported because APKs always carry a regular signature next to them.
+var sigAlgorithms = []uint32{
+	sigRSAPSSSHA512,
+	sigRSAPKCS1SHA512,
+	sigECDSASHA512,
+	sigRSAPSSSHA256,
+	sigRSAPKCS1SHA256,
+	sigECDSASHA256,
+	sigDSASHA256}
+
+func sigHash(algo uint32) crypto.Hash {
+	switch algo {
+	case sigRSAPSSSHA512, sigRSAPKCS1SHA512, sigECDSASHA512:
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+// Signature describes how an APK was signed
+type Signature struct {
+	Scheme       int                 // 1, 2 or 3
+	Certificates []*x509.Certificate // The certificate of each signer
+}
+
+// lengthPrefixed reads a uint32 little endian length followed by that many bytes
+func lengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("Truncated length-prefixed value")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, fmt.Errorf("Length-prefixed value of %v bytes exceeds remaining %v bytes", n, len(data)-4)
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// sequence splits a length-prefixed sequence of length-prefixed values
+func sequence(data []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(data) > 0 {
+		item, rest, err := lengthPrefixed(data)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		data = rest
+	}
+	return items, nil
+}
+
+func readUint32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("Truncated value")
+	}
+	return binary.LittleEndian.Uint32(data), data[4:], nil
+}
+
+// zipSections locates the parts of an APK that v2/v3 signatures cover
+type zipSections struct {
+	size       int64
+	eocd       []byte
+	eocdOffset int64
+	cdOffset   int64
+	cdSize     int64
+}
+
+func findZipSections(file *os.File) (*zipSections, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	// The end of central directory record is 22 bytes plus a comment of up
+	// to 65535 bytes at the end of the file
+	tailSize := int64(22 + 65535)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	_, err = file.ReadAt(tail, size-tailSize)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading end of file:\n  %v", err)
+	}
+	for i := len(tail) - 22; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) != 0x06054b50 {
+			continue
+		}
+		commentLen := int(binary.LittleEndian.Uint16(tail[i+20:]))
+		if i+22+commentLen != len(tail) {
+			continue
+		}
+		sections := &zipSections{
+			size:       size,
+			eocd:       tail[i:],
+			eocdOffset: size - tailSize + int64(i),
+			cdOffset:   int64(binary.LittleEndian.Uint32(tail[i+16:])),
+			cdSize:     int64(binary.LittleEndian.Uint32(tail[i+12:]))}
+		if sections.cdOffset+sections.cdSize != sections.eocdOffset {
+			return nil, fmt.Errorf("ZIP central directory is not immediately followed by the end of central directory record")
+		}
+		return sections, nil
+	}
+	return nil, fmt.Errorf("Not a ZIP file: no end of central directory record")
+}
+
+// findSigningBlock returns the ID-value pairs of the APK Signing Block and
+// its offset, or nil if the APK has no signing block
+func findSigningBlock(file *os.File, sections *zipSections) (map[uint32][]byte, int64, error) {
+	if sections.cdOffset < 32 {
+		return nil, 0, nil
+	}
+	footer := make([]byte, 24)
+	_, err := file.ReadAt(footer, sections.cdOffset-24)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error while reading APK Signing Block footer:\n  %v", err)
+	}
+	if string(footer[8:]) != sigBlockMagic {
+		return nil, 0, nil
+	}
+
+	// The size is checked before converting it, as a huge value would wrap
+	// around to a negative one
+	blockSize := binary.LittleEndian.Uint64(footer)
+	if blockSize < 24 || blockSize > uint64(sections.cdOffset)-8 {
+		return nil, 0, fmt.Errorf("Invalid APK Signing Block size %v", blockSize)
+	}
+	start := sections.cdOffset - int64(blockSize) - 8
+	block := make([]byte, blockSize+8)
+	_, err = file.ReadAt(block, start)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error while reading APK Signing Block:\n  %v", err)
+	}
+	if binary.LittleEndian.Uint64(block) != blockSize {
+		return nil, 0, fmt.Errorf("APK Signing Block sizes do not match")
+	}
+
+	pairs := make(map[uint32][]byte)
+	data := block[8 : len(block)-24]
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, 0, fmt.Errorf("Truncated APK Signing Block entry")
+		}
+		length := binary.LittleEndian.Uint64(data)
+		if length < 4 || length > uint64(len(data)-8) {
+			return nil, 0, fmt.Errorf("Invalid APK Signing Block entry length %v", length)
+		}
+		id := binary.LittleEndian.Uint32(data[8:])
+		pairs[id] = data[12 : 8+length]
+		data = data[8+length:]
+	}
+	return pairs, start, nil
+}
+
+// contentDigest computes the chunked digest v2 and v3 signatures cover
+func contentDigest(file *os.File, sections *zipSections, blockOffset int64, hash crypto.Hash) ([]byte, error) {
+	// The central directory offset in the EOCD is replaced by the offset of
+	// the signing block, as it was before the block was inserted
+	eocd := make([]byte, len(sections.eocd))
+	copy(eocd, sections.eocd)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(blockOffset))
+
+	readers := []io.Reader{
+		io.NewSectionReader(file, 0, blockOffset),
+		io.NewSectionReader(file, sections.cdOffset, sections.cdSize),
+		bytes.NewReader(eocd)}
+	lengths := []int64{blockOffset, sections.cdSize, int64(len(eocd))}
+
+	var chunks int64
+	for _, length := range lengths {
+		chunks += (length + chunkSize - 1) / chunkSize
+	}
+
+	top := hash.New()
+	prefix := make([]byte, 5)
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(chunks))
+	top.Write(prefix)
+
+	buf := make([]byte, chunkSize)
+	for i, reader := range readers {
+		for remaining := lengths[i]; remaining > 0; {
+			n := int64(chunkSize)
+			if remaining < n {
+				n = remaining
+			}
+			_, err := io.ReadFull(reader, buf[:n])
+			if err != nil {
+				return nil, fmt.Errorf("Error while reading APK contents:\n  %v", err)
+			}
+			h := hash.New()
+			prefix[0] = 0xa5
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+			h.Write(prefix)
+			h.Write(buf[:n])
+			top.Write(h.Sum(nil))
+			remaining -= n
+		}
+	}
+	return top.Sum(nil), nil
+}
+
+func verifyRaw(pub crypto.PublicKey, algo uint32, data, sig []byte) error {
+	hash := sigHash(algo)
+	switch algo {
+	case sigRSAPSSSHA256, sigRSAPSSSHA512:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("RSA signature with %T key", pub)
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPSS(key, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case sigRSAPKCS1SHA256, sigRSAPKCS1SHA512, sigECDSASHA256, sigECDSASHA512, sigDSASHA256:
+		return jar.CheckSignature(pub, hash, data, sig)
+	}
+	return fmt.Errorf("Unsupported signature algorithm 0x%04x", algo)
+}
+
+// verifySigner checks one signer of a v2 or v3 block and returns its
+// certificate along with the digest algorithm and expected content digest
+func verifySigner(signer []byte, v3 bool) (*x509.Certificate, uint32, []byte, error) {
+	signedData, rest, err := lengthPrefixed(signer)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if v3 {
+		// Minimum and maximum SDK versions, repeated in the signed data
+		if len(rest) < 8 {
+			return nil, 0, nil, fmt.Errorf("Truncated v3 signer")
+		}
+		rest = rest[8:]
+	}
+	sigsData, rest, err := lengthPrefixed(rest)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	pubData, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(pubData)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Error while parsing signer public key:\n  %v", err)
+	}
+
+	sigs, err := sequence(sigsData)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	available := make(map[uint32][]byte)
+	for _, sig := range sigs {
+		algo, rest, err := readUint32(sig)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		value, _, err := lengthPrefixed(rest)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		available[algo] = value
+	}
+	var algo uint32
+	for _, candidate := range sigAlgorithms {
+		if _, ok := available[candidate]; ok {
+			algo = candidate
+			break
+		}
+	}
+	if algo == 0 {
+		return nil, 0, nil, fmt.Errorf("Signer uses no supported signature algorithm")
+	}
+	err = verifyRaw(pub, algo, signedData, available[algo])
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Invalid signature:\n  %v", err)
+	}
+
+	// Only trust the signed data once its signature has been verified
+	digestsData, rest, err := lengthPrefixed(signedData)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	certsData, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	digests, err := sequence(digestsData)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var expected []byte
+	for _, d := range digests {
+		digestAlgo, rest, err := readUint32(d)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if digestAlgo == algo {
+			expected, _, err = lengthPrefixed(rest)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+		}
+	}
+	if expected == nil {
+		return nil, 0, nil, fmt.Errorf("No content digest for signature algorithm 0x%04x", algo)
+	}
+
+	certs, err := sequence(certsData)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, 0, nil, fmt.Errorf("Signer has no certificates")
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Error while parsing signer certificate:\n  %v", err)
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, pubData) {
+		return nil, 0, nil, fmt.Errorf("Signer certificate does not match the signing key")
+	}
+	return cert, algo, expected, nil
+}
+
+func verifyBlock(file *os.File, sections *zipSections, blockOffset int64, block []byte, v3 bool) ([]*x509.Certificate, error) {
+	signersData, _, err := lengthPrefixed(block)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := sequence(signersData)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("No signers found")
+	}
+
+	var certs []*x509.Certificate
+	digests := make(map[crypto.Hash][]byte)
+	for i, signer := range signers {
+		cert, algo, expected, err := verifySigner(signer, v3)
+		if err != nil {
+			return nil, fmt.Errorf("Error while verifying signer %v:\n  %v", i+1, err)
+		}
+		hash := sigHash(algo)
+		if digests[hash] == nil {
+			digests[hash], err = contentDigest(file, sections, blockOffset, hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !bytes.Equal(digests[hash], expected) {
+			return nil, fmt.Errorf("APK contents do not match the digest signed by %v", cert.Subject)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// v1StrippingCheck returns an error if the v1 signature says the APK was also
+// signed with a newer scheme, which means that signature was removed
+func v1StrippingCheck(reader *zip.Reader) error {
+	for _, file := range reader.File {
+		upper := strings.ToUpper(file.Name)
+		if !strings.HasPrefix(upper, "META-INF/") || path.Ext(upper) != ".SF" {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("Error while opening %v:\n  %v", file.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("Error while reading %v:\n  %v", file.Name, err)
+		}
+		signed := jar.ParseManifest(data).Main.Attributes["X-ANDROID-APK-SIGNED"]
+		for _, scheme := range strings.Split(signed, ",") {
+			if scheme = strings.TrimSpace(scheme); scheme == "2" || scheme == "3" {
+				return fmt.Errorf("APK Signature Scheme v%v signature was stripped", scheme)
+			}
+		}
+	}
+	return nil
+}
+
+// VerifySignature checks the strongest signature scheme present in the APK
+// at path and returns the certificates of its signers
+func VerifySignature(apkPath string) (*Signature, error) {
+	file, err := os.Open(apkPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %v:\n  %v", apkPath, err)
+	}
+	defer file.Close()
+
+	sections, err := findZipSections(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %v:\n  %v", apkPath, err)
+	}
+	pairs, blockOffset, err := findSigningBlock(file, sections)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %v:\n  %v", apkPath, err)
+	}
+
+	if block, ok := pairs[blockIdV3]; ok {
+		certs, err := verifyBlock(file, sections, blockOffset, block, true)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid APK Signature Scheme v3 signature on %v:\n  %v", apkPath, err)
+		}
+		return &Signature{Scheme: 3, Certificates: certs}, nil
+	}
+	if block, ok := pairs[blockIdV2]; ok {
+		certs, err := verifyBlock(file, sections, blockOffset, block, false)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid APK Signature Scheme v2 signature on %v:\n  %v", apkPath, err)
+		}
+		return &Signature{Scheme: 2, Certificates: certs}, nil
+	}
+
+	reader, err := zip.NewReader(file, sections.size)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %v:\n  %v", apkPath, err)
+	}
+	err = v1StrippingCheck(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature on %v:\n  %v", apkPath, err)
+	}
+	certs, err := jar.Verify(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JAR signature on %v:\n  %v", apkPath, err)
+	}
+	return &Signature{Scheme: 1, Certificates: certs}, nil
+}
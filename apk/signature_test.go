@@ -0,0 +1,96 @@
+package apk
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+)
+
+// withSigningBlockFooter returns an empty ZIP whose central directory is
+// preceded by filler and an APK Signing Block footer claiming blockSize
+func withSigningBlockFooter(filler int, blockSize uint64) []byte {
+	data := make([]byte, filler, filler+24+22)
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(footer, blockSize)
+	data = append(data, footer...)
+	data = append(data, sigBlockMagic...)
+
+	eocd := make([]byte, 22)
+	binary.LittleEndian.PutUint32(eocd, 0x06054b50)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(len(data)))
+	return append(data, eocd...)
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "test.apk")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFindSigningBlockSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockSize uint64
+	}{
+		{"too small", 8},
+		{"larger than file", 1 << 20},
+		{"wraps negative", 1 << 63},
+		{"maximum", ^uint64(0)},
+	}
+	for _, test := range tests {
+		file, err := os.Open(writeTemp(t, withSigningBlockFooter(64, test.blockSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections, err := findZipSections(file)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		_, _, err = findSigningBlock(file, sections)
+		file.Close()
+		if err == nil || !strings.Contains(err.Error(), "Invalid APK Signing Block size") {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifySignatureV1(t *testing.T) {
+	sig, err := VerifySignature("../jar/testdata/signed.jar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Scheme != 1 || len(sig.Certificates) != 1 {
+		t.Fatalf("got scheme %v with %v signers", sig.Scheme, len(sig.Certificates))
+	}
+	const expected = "f42a7d78cc33aecd7696a437ef6f225dc711751190be91775de4a92dd2806d4a"
+	if fp := jar.Fingerprint(sig.Certificates[0]); fp != expected {
+		t.Errorf("fingerprint is %v, expected %v", fp, expected)
+	}
+}
+
+func TestVerifySignatureUnsigned(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	out, err := w.Create("AndroidManifest.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("unsigned"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = VerifySignature(writeTemp(t, buf.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
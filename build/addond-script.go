@@ -6,8 +6,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
 
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
@@ -15,14 +13,12 @@ import (
 func genAddondScript(dest string, zip *lib.ZipInfo, backupFiles map[string]bool, deleteFiles map[string]bool) error {
 	lib.Debug("GENERATING ADDON.D AT " + dest)
 	var script bytes.Buffer
-	script.WriteString(`#!/sbin/sh
+	script.WriteString(`#!/system/bin/sh
 #
 # This addon.d script was automatically generated
 # It backs up the files installed by `)
 
-	zip.Mux.RLock()
 	script.WriteString(zip.Name)
-	zip.Mux.RUnlock()
 	script.WriteString(`.zip
 # If there are any issues, send an email to admin@shadow53.com
 # describing the issue
@@ -34,7 +30,7 @@ list_files() {
   cat <<EOF
 `)
 
-	for file, _ := range backupFiles {
+	for _, file := range lib.SortedKeys(backupFiles) {
 		script.WriteString(file + "\n")
 	}
 
@@ -52,7 +48,7 @@ case "$1" in
   restore)
 `)
 
-	for file := range deleteFiles {
+	for _, file := range lib.SortedKeys(deleteFiles) {
 		script.WriteString("  rm -r ")
 		script.WriteString(file)
 		script.WriteString("\n")
@@ -85,140 +81,63 @@ esac`)
 	return nil
 }
 
-func makeAddondScripts(root string, zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files) error {
+// addBackupFiles adds the files an item installs on a system partition to
+// backupFiles and the files it removes on updates to deleteFiles
+func addBackupFiles(item *planItem, ver, arch string, backupFiles, deleteFiles map[string]bool) {
+	lib.Debug("Processing " + item.Name + " for backup")
+	info := item.Version[ver]
+	if info == nil {
+		return
+	}
+	if !info.HasArchSpecificInfo {
+		arch = lib.NOARCH
+	}
+	file := info.Arch[arch]
+	if file == nil {
+		return
+	}
+	if rel := lib.SystemRelative(file.Destination); rel != "" {
+		lib.Debug("BACKING UP: " + file.Destination)
+		backupFiles[rel] = true
+	} else {
+		lib.Debug(item.Name + " IS NOT ON A SYSTEM PARTITION")
+	}
+	for _, del := range file.UpdateRemoveFiles {
+		lib.Debug("DELETING FILE: " + del)
+		deleteFiles[del] = true
+	}
+}
+
+func makeAddondScripts(z *zipBuild) error {
 	fmt.Println("Generating addon.d recovery script(s)")
+	zip := z.Plan.Zip
 	addondFile := make(map[string]*lib.AndroidVersionInfo)
-	// Set to lowest version so it is set if nothing is installed, for when a zip only removes
-	baseVersion := zip.Versions[0]
-	var baseMux sync.Mutex
-
-	zip.RLock()
-	zipApps := zip.Apps
-	zipFiles := zip.Files
-	zip.RUnlock()
-	var wg sync.WaitGroup
 
 	backupFiles := make(map[string]bool)
-	var backupMux sync.Mutex
 	deleteFiles := make(map[string]bool)
-	var deleteMux sync.Mutex
-	var isArchSpecific bool
-	var archSpecificMux sync.Mutex
+	for _, del := range zip.UpdateRemoveFiles {
+		lib.Debug("DELETING FILE: " + del)
+		deleteFiles[del] = true
+	}
 
+	items := append(append([]*planItem{}, z.Plan.Apps...), z.files()...)
 	for _, ver := range zip.Versions {
 		lib.Debug("VERSION: " + ver)
 		for _, arch := range zip.Arches {
 			lib.Debug("ARCH: " + arch)
-
-			wg.Add(1)
-			var archwg sync.WaitGroup
-
-			for _, app := range zipApps {
-				archwg.Add(1)
-				go func(ver, arch, app string, baseVersion *string, backupFiles *map[string]bool, deleteFiles *map[string]bool, isArchSpecific *bool, baseMux, backupMux, deleteMux, archSpecificMux *sync.Mutex, wg *sync.WaitGroup) {
-					defer wg.Done()
-					lib.Debug("Processing " + app + " for backup")
-					apps.RLockApp(app)
-					defer apps.RUnlockApp(app)
-					if apps.AppVersionExists(app, ver) {
-						apps.RLockAppVersion(app, ver)
-						defer apps.RUnlockAppVersion(app, ver)
-						if !apps.GetAppVersion(app, ver).HasArchSpecificInfo {
-							arch = lib.NOARCH
-						}
-						if apps.AppVersionArchExists(app, ver, arch) {
-							apps.RLockAppVersionArch(app, ver, arch)
-							defer apps.RUnlockAppVersionArch(app, ver, arch)
-							if strings.HasPrefix(apps.GetAppVersionArch(app, ver, arch).Destination, "/system/") {
-								lib.Debug("BACKING UP APP: " + apps.GetAppVersionArch(app, ver, arch).Destination)
-								backupMux.Lock()
-								(*backupFiles)[apps.GetAppVersionArch(app, ver, arch).Destination[8:]] = true
-								backupMux.Unlock()
-								archSpecificMux.Lock()
-								*isArchSpecific = *isArchSpecific || apps.GetAppVersion(app, ver).HasArchSpecificInfo
-								archSpecificMux.Unlock()
-								baseMux.Lock()
-								if *baseVersion < apps.GetAppVersion(app, ver).Base {
-									*baseVersion = apps.GetAppVersion(app, ver).Base
-								}
-								baseMux.Unlock()
-							} else {
-								lib.Debug(app + " IS NOT IN /system/")
-							}
-							deleteMux.Lock()
-							for _, del := range apps.GetAppVersionArch(app, ver, arch).UpdateRemoveFiles {
-								lib.Debug("DELETING FILE: " + del)
-								(*deleteFiles)[del] = true
-							}
-							deleteMux.Unlock()
-						}
-					}
-				}(ver, arch, app, &baseVersion, &backupFiles, &deleteFiles, &isArchSpecific, &baseMux, &backupMux, &deleteMux, &archSpecificMux, &archwg)
-			}
-
-			for _, file := range zipFiles {
-				archwg.Add(1)
-				go func(ver, arch, file string, baseVersion *string, backupFiles *map[string]bool, deleteFiles *map[string]bool, isArchSpecific *bool, baseMux, backupMux, deleteMux, archSpecificMux *sync.Mutex, wg *sync.WaitGroup) {
-					defer wg.Done()
-					lib.Debug("Processing " + file + " for backup")
-					files.RLockFile(file)
-					defer files.RUnlockFile(file)
-					if files.FileVersionExists(file, ver) {
-						files.RLockFileVersion(file, ver)
-						defer files.RUnlockFileVersion(file, ver)
-						if !files.GetFileVersion(file, ver).HasArchSpecificInfo {
-							arch = lib.NOARCH
-						}
-						if files.FileVersionArchExists(file, ver, arch) {
-							files.RLockFileVersionArch(file, ver, arch)
-							defer files.RUnlockFileVersionArch(file, ver, arch)
-							if strings.HasPrefix(files.GetFileVersionArch(file, ver, arch).Destination, "/system/") {
-								lib.Debug("BACKING UP FILE: " + files.GetFileVersionArch(file, ver, arch).Destination)
-								backupMux.Lock()
-								(*backupFiles)[files.GetFileVersionArch(file, ver, arch).Destination[8:]] = true
-								backupMux.Unlock()
-								archSpecificMux.Lock()
-								*isArchSpecific = *isArchSpecific || files.GetFileVersion(file, ver).HasArchSpecificInfo
-								archSpecificMux.Unlock()
-								baseMux.Lock()
-								if *baseVersion < files.GetFileVersion(file, ver).Base {
-									*baseVersion = files.GetFileVersion(file, ver).Base
-								}
-								baseMux.Unlock()
-							}
-							deleteMux.Lock()
-							for _, del := range files.GetFileVersionArch(file, ver, arch).UpdateRemoveFiles {
-								lib.Debug("DELETING FILE: " + del)
-								(*deleteFiles)[del] = true
-							}
-							deleteMux.Unlock()
-						}
-					}
-				}(ver, arch, file, &baseVersion, &backupFiles, &deleteFiles, &isArchSpecific, &baseMux, &backupMux, &deleteMux, &archSpecificMux, &archwg)
-			}
-
-			zip.RLock()
-			deleteMux.Lock()
-			for _, del := range zip.UpdateRemoveFiles {
-				lib.Debug("DELETING FILE: " + del)
-				deleteFiles[del] = true
+			for _, item := range items {
+				addBackupFiles(item, ver, arch, backupFiles, deleteFiles)
 			}
-			deleteMux.Unlock()
-			zip.RUnlock()
-			archwg.Wait()
-			wg.Done()
 		}
 	}
 
-	wg.Wait()
-
 	if len(backupFiles)+len(deleteFiles) > 0 {
-		scriptDest := filepath.Join(root, "files")
+		scriptDest := filepath.Join(z.Root, "files")
 		err := os.MkdirAll(scriptDest, os.ModeDir|0755)
 		if err != nil {
 			return fmt.Errorf("Error while making parent directories for %v:\n  %v", scriptDest, err)
 		}
-		fileName := "addond-" + lib.Versions[0]
+		fileName := "addond-" + z.Plan.Versions.Versions[0]
 		fileName = fileName + ".sh"
 		scriptDest = filepath.Join(scriptDest, fileName)
 
@@ -229,43 +148,24 @@ func makeAddondScripts(root string, zip *lib.ZipInfo, apps *lib.Apps, files *lib
 		}
 		lib.Debug("SUCCESSFULLY GENERATED ADDON.D AT " + scriptDest)
 
-        zip.RLock()
-        for _, ver := range zip.Versions {
-            if addondFile[ver] == nil {
-                addondFile[ver] = &lib.AndroidVersionInfo{
-                    Base:                zip.Versions[0],
-                    HasArchSpecificInfo: false,
-                    Arch:                make(map[string]*lib.FileInfo)}
-            }
-            addondFile[ver].Arch[lib.NOARCH] = &lib.FileInfo{
-                Destination: "/system/addon.d/05-" + zip.Name + ".sh",
-                Mode:        "0644",
-                FileName:    fileName}
-        }
-        zip.RUnlock()
+		for _, ver := range zip.Versions {
+			if addondFile[ver] == nil {
+				addondFile[ver] = &lib.AndroidVersionInfo{
+					Base:                zip.Versions[0],
+					HasArchSpecificInfo: false,
+					Arch:                make(map[string]*lib.FileInfo)}
+			}
+			addondFile[ver].Arch[lib.NOARCH] = &lib.FileInfo{
+				Destination: "/system/addon.d/05-" + zip.Name + ".sh",
+				Mode:        "0644",
+				FileName:    fileName}
+		}
 	} else {
 		lib.Debug("NO FILES TO BACK UP OR DELETE. SKIPPING")
 	}
 
-	lib.Debug("AWAITING APP AND FILE BACKUP PROCESSING")
-	wg.Wait()
-	lib.Debug("APP AND FILE BACKUP PROCESSING COMPLETE")
 	// File was created, add to files list for installation
 	lib.Debug("ADDING ADDON.D FILE TO FILE LIST")
-	zip.RLock()
-	fileId := zip.Name + "-addond"
-	zip.RUnlock()
-	files.Lock()
-	files.SetFile(fileId, &lib.AndroidVersions{})
-	files.Unlock()
-
-	files.LockFile(fileId)
-	files.GetFile(fileId).Version = addondFile
-	files.UnlockFile(fileId)
-
-	lib.Debug("ADDING ADDON.D FILE TO ZIP FILE LIST")
-	zip.Lock()
-	zip.Files = append(zip.Files, fileId)
-	zip.Unlock()
+	z.Extra = append(z.Extra, &planItem{Name: zip.Name + "-addond", Version: addondFile})
 	return nil
 }
@@ -1,67 +1,94 @@
 package build
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
-	"sync"
 
-	"gitlab.com/Shadow53/zip-builder/dl"
+	"gitlab.com/Shadow53/zip-builder/apk"
+	"gitlab.com/Shadow53/zip-builder/jar"
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
-func downloadApp(apps *lib.Apps, zip *lib.ZipInfo, app, ver, arch, apppath string) error {
-	if apps.GetApp(app).UrlIsFDroidRepo {
-		// Create separate variable to get around not being able to address map items
-		err := dl.DownloadFromFDroidRepo(apps.GetApp(app), zip, ver, arch, apppath)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := dl.Download(apps.GetAppVersionArch(app, ver, arch).Url, apppath)
-		if err != nil {
-			return fmt.Errorf("Error while downloading %v to %v:\n  %v",
-				apps.GetAppVersionArch(app, ver, arch).Url, apppath, err)
+// inspectApp reads the manifest of a downloaded APK to catch configuration
+// mistakes. The manifest fills in what was not configured.
+func inspectApp(app *lib.AppInfo, ver string, sdk int, apppath string) (*apk.Info, error) {
+	info, err := apk.Inspect(apppath)
+	if err != nil {
+		return nil, err
+	}
+	lib.Debug(fmt.Sprintf("APK %v: %+v", apppath, *info))
+
+	if info.PackageName != app.PackageName {
+		return nil, fmt.Errorf("Downloaded APK is %v, but package_name is configured as %v", info.PackageName, app.PackageName)
+	}
+
+	if info.MinSdk > sdk {
+		fmt.Printf("WARNING: %v requires SDK %v but is configured for Android %v (SDK %v) and will not install there\n",
+			app.PackageName, info.MinSdk, ver, sdk)
+	}
+	return info, nil
+}
+
+// verifySigner checks the APK signature and, if signer_sha256 is set, that
+// every signer is one of the pinned certificates
+func verifySigner(app *lib.AppInfo, apppath string) error {
+	if len(app.SignerSHA256) == 0 {
+		return nil
+	}
+	sig, err := apk.VerifySignature(apppath)
+	if err != nil {
+		return err
+	}
+	for _, cert := range sig.Certificates {
+		fingerprint := jar.Fingerprint(cert)
+		lib.Debug(fmt.Sprintf("APK %v SIGNED (V%v) BY %v WITH SHA-256 %v", apppath, sig.Scheme, cert.Subject, fingerprint))
+		if !lib.StringSliceContains(app.SignerSHA256, fingerprint) {
+			return fmt.Errorf("%v is signed by %v with SHA-256 %v, which is not listed in signer_sha256",
+				app.PackageName, cert.Subject, fingerprint)
 		}
 	}
 	return nil
 }
 
-func DownloadApp(zip *lib.ZipInfo, files *lib.Files, apps *lib.Apps, app, ver, arch, zippath string, ch chan error, wg *sync.WaitGroup) {
-	defer wg.Done()
-	apps.RLockAppVersion(app, ver)
-	defer apps.RUnlockAppVersion(app, ver)
-	if apps.AppVersionArchExists(app, ver, arch) {
-		apps.LockAppVersionArch(app, ver, arch)
-		defer apps.UnlockAppVersionArch(app, ver, arch)
-		// Build file name with version/architecture
-		filename := apps.GetApp(app).PackageName + "-" + apps.GetAppVersion(app, ver).Base
-		if apps.GetAppVersion(app, ver).HasArchSpecificInfo {
-			filename = filename + "-" + arch
-		}
-		filename = filename + ".apk"
-		lib.Debug("APP " + app + " FOR " + ver + " " + arch + " WILL BE SAVED AS " + filename)
-		// Set file name for app
-		apps.GetAppVersionArch(app, ver, arch).FileName = filename
-		apppath := filepath.Join(zippath, "files", filename)
+// downloadApp downloads an app of the plan into zippath/files, checks it and
+// extracts its libraries if it is installed to a system partition
+func (b *Builder) downloadApp(ctx context.Context, plan *zipPlan, download *planDownload, zippath string) (downloaded, error) {
+	var result downloaded
+	app := download.Item.App
+	file := download.File
+	apppath := filepath.Join(zippath, "files", file.FileName)
 
-		// Download as necessary
-		err := downloadApp(apps, zip, app, ver, arch, apppath)
-		if err != nil {
-			ch <- fmt.Errorf("Error while downloading app \"%v\":\n  %v", apps.GetApp(app).PackageName, err)
-			return
-		}
+	// Apps from F-Droid were resolved to an APK when planning
+	src, mirrors := file.Url, file.Mirrors
+	if file.ResolvedUrl != "" {
+		src, mirrors = file.ResolvedUrl, file.ResolvedMirrors
+	}
+	err := b.dl.Download(ctx, src, apppath, file.Checksums(), mirrors...)
+	if err != nil {
+		return result, fmt.Errorf("Error while downloading app \"%v\":\n  Error while downloading %v to %v:\n  %w",
+			app.PackageName, src, apppath, err)
+	}
 
-		// Test checksums
-		err = checkChecksums(apps.GetAppVersionArch(app, ver, arch), apppath)
-		if err != nil {
-			ch <- fmt.Errorf("Error while downloading app \"%v\":\n %v", app, err)
-			return
-		}
+	// Test checksums
+	err = checkChecksums(file, apppath)
+	if err != nil {
+		return result, fmt.Errorf("Error while downloading app \"%v\":\n %v", download.Item.Name, err)
+	}
 
-		err = unzipSystemLibs(zippath, zip, apps.GetApp(app), ver, arch, files)
-		if err != nil {
-			ch <- fmt.Errorf("Error while unzipping libs from %v:\n  %v", apps.GetApp(app).PackageName, err)
-			return
-		}
+	err = verifySigner(app, apppath)
+	if err != nil {
+		return result, fmt.Errorf("Error while verifying signature of app \"%v\":\n  %v", download.Item.Name, err)
+	}
+
+	result.Apk, err = inspectApp(app, download.Ver, plan.Versions.SdkLevel(download.Ver), apppath)
+	if err != nil {
+		return result, fmt.Errorf("Error while checking app \"%v\":\n  %v", download.Item.Name, err)
+	}
+
+	result.Libs, err = b.unzipSystemLibs(ctx, zippath, plan, download)
+	if err != nil {
+		return result, fmt.Errorf("Error while unzipping libs from %v:\n  %w", app.PackageName, err)
 	}
+	return result, nil
 }
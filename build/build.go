@@ -1,13 +1,15 @@
 package build
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
-	"github.com/spf13/viper"
-	"gitlab.com/Shadow53/zip-builder/dl"
+	"gitlab.com/Shadow53/zip-builder/apk"
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
@@ -21,7 +23,7 @@ func checkChecksums(file *lib.FileInfo, path string) error {
 		if err != nil {
 			return fmt.Errorf("Error while calculating md5sum of %v:\n  %v", path, err)
 		}
-		if sum != md5sum {
+		if !strings.EqualFold(sum, md5sum) {
 			lib.Debug("Wrong MD5SUM")
 			return fmt.Errorf("Unexpected md5sum. Expected %v but got %v", md5sum, sum)
 		}
@@ -32,8 +34,8 @@ func checkChecksums(file *lib.FileInfo, path string) error {
 		if err != nil {
 			return fmt.Errorf("Error while calculating sha1sum of %v:\n  %v", path, err)
 		}
-		if sum != sha1sum {
-			return fmt.Errorf("Unexpected md5sum. Expected %v but got %v", sha1sum, sum)
+		if !strings.EqualFold(sum, sha1sum) {
+			return fmt.Errorf("Unexpected sha1sum. Expected %v but got %v", sha1sum, sum)
 		}
 	}
 	if sha256sum != "" {
@@ -42,40 +44,41 @@ func checkChecksums(file *lib.FileInfo, path string) error {
 		if err != nil {
 			return fmt.Errorf("Error while calculating sha256sum of %v:\n  %v", path, err)
 		}
-		if sum != sha256sum {
+		if !strings.EqualFold(sum, sha256sum) {
 			return fmt.Errorf("Unexpected sha256sum. Expected %v but got %v", sha256sum, sum)
 		}
 	}
 	return nil
 }
 
-// TODO: Change app dl-ing to error if app doesn't exist
-func MakeZip(zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files, ch chan error) {
-	zip.RLock()
-	lib.Debug("BUILDING ZIP: " + zip.Name)
-	zippath := filepath.Join(viper.GetString("tempdir"), "build", zip.Name)
-	zip.RUnlock()
-	// Build zip root with files subdir
-	err := os.MkdirAll(filepath.Join(zippath, "files"), os.ModeDir|0755)
-	if err != nil {
-		ch <- fmt.Errorf("Error while creating directory: %v\n  %v", filepath.Join(zippath, "files"), err)
-		return
+// skipIfUpToDate reports whether the zip, and its uninstaller if it has one,
+// were already built with fingerprint
+func (b *Builder) skipIfUpToDate(zip *lib.ZipInfo, fingerprint string) bool {
+	lib.Debug("FINGERPRINT OF " + zip.Name + ": " + fingerprint)
+	if !b.opts.Force && b.isUpToDate(zip.Name, fingerprint) &&
+		(!zip.Uninstaller || b.isUpToDate(zip.Name+"-uninstall", fingerprint)) {
+		fmt.Println(zip.Name + " is up to date, skipping it. Use -force to rebuild it anyway.")
+		return true
 	}
-	defer os.RemoveAll(zippath)
+	return false
+}
 
-	// Download apps
-	zip.RLock()
-	zipApps := zip.Apps
-	zipFiles := zip.Files
-	zip.RUnlock()
+// downloaded is what downloading a file of a plan found out
+type downloaded struct {
+	Apk  *apk.Info   // The manifest of an app, nil for files
+	Libs []*planItem // Libraries extracted from an app
+}
 
+// downloadZip downloads the apps and files of a zip into its root folder,
+// sending any errors to ch. It returns whether everything was downloaded.
+func (b *Builder) downloadZip(ctx context.Context, z *zipBuild, ch chan error) bool {
 	var zipwg, errwg sync.WaitGroup
 	cherr := make(chan error)
 	doBuild := true
 
 	// Don't continue if an error occurred
+	errwg.Add(1)
 	go func(receive, send chan error, doBuild *bool, wg *sync.WaitGroup) {
-		wg.Add(1)
 		for err := range receive {
 			send <- err
 			*doBuild = false
@@ -83,63 +86,23 @@ func MakeZip(zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files, ch chan error)
 		wg.Done()
 	}(cherr, ch, &doBuild, &errwg)
 
-	for _, app := range zipApps {
-		lib.Debug("CHECKING TO DOWNLOAD " + app)
-		for _, ver := range zip.Versions {
-			appVer := ""
-			hasArchInfo := false
-			apps.RLockApp(app)
-			if apps.AppVersionExists(app, ver) {
-				apps.RLockAppVersion(app, ver)
-				appVer = apps.GetAppVersion(app, ver).Base
-				hasArchInfo = apps.GetAppVersion(app, ver).HasArchSpecificInfo
-				apps.RUnlockAppVersion(app, ver)
+	// Each download has its own result so nothing is shared between them
+	results := make([]downloaded, len(z.Plan.Downloads))
+	for i, download := range z.Plan.Downloads {
+		lib.Debug("DOWNLOADING " + download.Item.Name + " FOR " + download.Ver + " " + download.Arch)
+		zipwg.Add(1)
+		go func(i int, download *planDownload) {
+			defer zipwg.Done()
+			var err error
+			if download.Item.App != nil {
+				results[i], err = b.downloadApp(ctx, z.Plan, download, z.Root)
+			} else {
+				err = b.downloadFile(ctx, download, z.Root)
 			}
-			apps.RUnlockApp(app)
-
-			if appVer == ver {
-				if hasArchInfo {
-					zipwg.Add(len(zip.Arches))
-					lib.Debug("Added download for each arch")
-					for _, arch := range zip.Arches {
-						go DownloadApp(zip, files, apps, app, ver, arch, zippath, cherr, &zipwg)
-					}
-				} else {
-					zipwg.Add(1)
-					lib.Debug("Added one download")
-					go DownloadApp(zip, files, apps, app, ver, lib.NOARCH, zippath, cherr, &zipwg)
-				}
+			if err != nil {
+				cherr <- err
 			}
-		}
-	}
-
-	// Download other files
-	for _, file := range zipFiles {
-		lib.Debug("CHECKING TO DOWNLOAD " + file)
-		for _, ver := range zip.Versions {
-			fileVer := ""
-			hasArchInfo := false
-			files.RLockFile(file)
-			if files.FileVersionExists(file, ver) {
-				files.RLockFileVersion(file, ver)
-				fileVer = files.GetFileVersion(file, ver).Base
-				hasArchInfo = files.GetFileVersion(file, ver).HasArchSpecificInfo
-				files.RUnlockFileVersion(file, ver)
-			}
-			files.RUnlockFile(file)
-
-			if fileVer == ver {
-				if hasArchInfo {
-					zipwg.Add(len(zip.Arches))
-					for _, arch := range zip.Arches {
-						go DownloadFile(files, file, ver, arch, zippath, cherr, &zipwg)
-					}
-				} else {
-					zipwg.Add(1)
-					go DownloadFile(files, file, ver, lib.NOARCH, zippath, cherr, &zipwg)
-				}
-			}
-		}
+		}(i, download)
 	}
 
 	lib.Verbose("Waiting for files and apps to finish downloading")
@@ -147,55 +110,176 @@ func MakeZip(zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files, ch chan error)
 	close(cherr)
 	errwg.Wait()
 
-	if !doBuild {
-		zip.RLock()
+	for i, download := range z.Plan.Downloads {
+		if results[i].Apk != nil {
+			z.Apks[download.File] = results[i].Apk
+		}
+		z.Extra = append(z.Extra, results[i].Libs...)
+	}
+	// Libraries are sorted to install in the same order on every build
+	sort.Slice(z.Extra, func(i, j int) bool {
+		return z.Extra[i].Name < z.Extra[j].Name
+	})
+	return doBuild
+}
+
+// TODO: Change app dl-ing to error if app doesn't exist
+// makeZip builds a zip and its uninstaller into the destination folder
+func (b *Builder) makeZip(ctx context.Context, dir string, plan *zipPlan, ch chan error) Status {
+	if ctx.Err() != nil {
+		return StatusCancelled
+	}
+	zip := plan.Zip
+	lib.Debug("BUILDING ZIP: " + zip.Name)
+	zippath := filepath.Join(dir, "build", zip.Name)
+
+	// When every download is pinned or cached, an unchanged zip is skipped
+	// without downloading anything
+	inputs, err := newFingerprintInputs(plan)
+	if err != nil {
+		ch <- fmt.Errorf("Error while fingerprinting %v:\n  %v", zip.Name, err)
+		return StatusFailed
+	}
+	fingerprint, known := inputs.fingerprint(b.knownDigest)
+	if known && b.skipIfUpToDate(zip, fingerprint) {
+		return StatusSkipped
+	}
+
+	// Build zip root with files subdir
+	err = os.MkdirAll(filepath.Join(zippath, "files"), os.ModeDir|0755)
+	if err != nil {
+		ch <- fmt.Errorf("Error while creating directory: %v\n  %v", filepath.Join(zippath, "files"), err)
+		return StatusFailed
+	}
+	defer os.RemoveAll(zippath)
+
+	z := newZipBuild(plan, zippath)
+	if !b.downloadZip(ctx, z, ch) {
 		fmt.Println("Error(s) occurred while downloading apps/files for " + zip.Name)
 		fmt.Println(zip.Name + " will not be built unless errors are resolved.")
-		zip.RUnlock()
-		return
+		return StatusFailed
+	}
+	if ctx.Err() != nil {
+		return StatusCancelled
 	}
 
-	err = makePermsFile(zippath, zip, apps, files)
+	if !known {
+		fingerprint, err = inputs.downloadedFingerprint(zippath)
+		if err != nil {
+			ch <- fmt.Errorf("Error while fingerprinting %v:\n  %v", zip.Name, err)
+			return StatusFailed
+		}
+		if b.skipIfUpToDate(zip, fingerprint) {
+			return StatusSkipped
+		}
+	}
+
+	err = makePermsFile(z)
 	if err != nil {
 		ch <- fmt.Errorf("Error while creating permissions file:\n  %v", err)
-		return
+		return StatusFailed
 	}
 
-	err = makeSysconfigFile(zippath, zip, apps, files)
+	err = makeSysconfigFile(z)
 	if err != nil {
 		ch <- fmt.Errorf("Error while creating sysconfig file:\n  %v", err)
-		return
+		return StatusFailed
 	}
 
-	err = makeAddondScripts(zippath, zip, apps, files)
+	err = makePrivappPermsFile(z)
 	if err != nil {
-		lib.Debug("ERROR GENERATING ADDON.D")
-		ch <- fmt.Errorf("Error while creating addon.d survival script:\n  %v", err)
-		return
+		ch <- fmt.Errorf("Error while creating privapp-permissions file:\n  %v", err)
+		return StatusFailed
 	}
 
-	err = makeUpdaterScript(zippath, zip, apps, files)
-	if err != nil {
-		ch <- fmt.Errorf("Error while creating updater-script:\n  %v", err)
-		return
+	// Magisk modules survive system updates without addon.d and are
+	// installed by Magisk, which mounts everything itself
+	isModule := zip.Output == lib.OutputMagisk
+
+	if !isModule {
+		err = makeAddondScripts(z)
+		if err != nil {
+			lib.Debug("ERROR GENERATING ADDON.D")
+			ch <- fmt.Errorf("Error while creating addon.d survival script:\n  %v", err)
+			return StatusFailed
+		}
 	}
 
-	// Source is hardcoded because I know it will not change until I change it
-	fmt.Println("Downloading update-binary")
-	err = dl.Download("https://gitlab.com/Shadow53/zip-builder/raw/master/update-binary", filepath.Join(zippath, "META-INF", "com", "google", "android", "update-binary"))
+	err = makeInstallScript(z)
 	if err != nil {
-		ch <- fmt.Errorf("Error while downloading update-binary from zip-builder repo:\n  %v", err)
-		return
+		ch <- fmt.Errorf("Error while creating installer script:\n  %v", err)
+		return StatusFailed
+	}
+
+	// The shell installer is its own update-binary
+	if !isModule && zip.Installer == lib.InstallerEdify {
+		err = writeUpdateBinary(zippath, zip)
+		if err != nil {
+			ch <- fmt.Errorf("Error while adding update-binary:\n  %v", err)
+			return StatusFailed
+		}
 	}
+
+	if !isModule {
+		err = writeMountScript(zippath)
+		if err != nil {
+			ch <- fmt.Errorf("Error while adding mount script:\n  %v", err)
+			return StatusFailed
+		}
+	}
+	if ctx.Err() != nil {
+		return StatusCancelled
+	}
+
 	// Generate zip and md5 file
-	zipLocation, err := zipFolder(zippath, zip)
+	zipLocation, err := b.zipFolder(zippath, zip.Name)
 	if err != nil {
 		ch <- fmt.Errorf("Error while zipping contents of %v:\n  %v", zippath, err)
-		return
+		return StatusFailed
+	}
+	signer, err := signZip(zipLocation, zip)
+	if err != nil {
+		ch <- fmt.Errorf("Error while signing zip at %v:\n  %v", zipLocation, err)
+		return StatusFailed
 	}
 	err = lib.GenerateMD5File(zipLocation)
 	if err != nil {
 		ch <- fmt.Errorf("Error while generating md5 for zip at %v:\n  %v", zipLocation, err)
-		return
+		return StatusFailed
+	}
+	err = makeManifest(z, zipLocation, signer, fingerprint)
+	if err != nil {
+		ch <- fmt.Errorf("Error while generating manifest for zip at %v:\n  %v", zipLocation, err)
+		return StatusFailed
+	}
+
+	if zip.Uninstaller {
+		err = b.makeUninstallZip(dir, z, fingerprint)
+		if err != nil {
+			ch <- fmt.Errorf("Error while creating uninstaller for %v:\n  %v", zip.Name, err)
+			return StatusFailed
+		}
+	}
+	return StatusBuilt
+}
+
+// fetchZip downloads the apps and files of a zip without building it
+func (b *Builder) fetchZip(ctx context.Context, dir string, plan *zipPlan, ch chan error) Status {
+	if ctx.Err() != nil {
+		return StatusCancelled
+	}
+	lib.Debug("FETCHING ZIP: " + plan.Zip.Name)
+	zippath := filepath.Join(dir, "fetch", plan.Zip.Name)
+	err := os.MkdirAll(filepath.Join(zippath, "files"), os.ModeDir|0755)
+	if err != nil {
+		ch <- fmt.Errorf("Error while creating directory: %v\n  %v", filepath.Join(zippath, "files"), err)
+		return StatusFailed
+	}
+	defer os.RemoveAll(zippath)
+
+	if !b.downloadZip(ctx, newZipBuild(plan, zippath), ch) {
+		return StatusFailed
 	}
+	fmt.Println("Fetched everything needed for " + plan.Zip.Name)
+	return StatusFetched
 }
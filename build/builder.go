@@ -0,0 +1,129 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"gitlab.com/Shadow53/zip-builder/config"
+	"gitlab.com/Shadow53/zip-builder/dl"
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Options control a Builder. Zero values use the defaults.
+type Options struct {
+	Destination string // Folder the zips are written to, "build" by default
+	TempDir     string // Where temporary build folders are created, the system default if empty
+	Force       bool   // Rebuild zips even if nothing they are built from has changed
+	FailFast    bool   // Cancel the other zips once one fails
+	Jobs        int    // Library extractions to run at once, the number of CPUs by default
+	Download    dl.Options
+}
+
+// Builder builds the zips of a configuration. Everything it needs is in its
+// Options, so several Builders can be used in one process.
+type Builder struct {
+	opts         Options
+	dl           *dl.Downloader
+	extractSlots lib.Semaphore
+}
+
+// New creates a Builder, filling in defaults for unset options
+func New(opts Options) *Builder {
+	if opts.Destination == "" {
+		opts.Destination = "build"
+	}
+	if opts.Jobs < 1 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	return &Builder{
+		opts:         opts,
+		dl:           dl.New(opts.Download),
+		extractSlots: lib.NewSemaphore(opts.Jobs)}
+}
+
+// Build builds the zips of cfg named in names, or every zip if names is
+// empty. Zips that fail are reported in the results, the error is only for
+// problems that stop every zip from being built.
+func (b *Builder) Build(ctx context.Context, cfg *config.Config, names []string) ([]Result, error) {
+	return b.run(ctx, cfg, names, b.makeZip)
+}
+
+// Fetch downloads everything the zips of cfg named in names need without
+// building them, which fills the download cache for later builds
+func (b *Builder) Fetch(ctx context.Context, cfg *config.Config, names []string) ([]Result, error) {
+	return b.run(ctx, cfg, names, b.fetchZip)
+}
+
+// MissingArtifacts lists every URL that could not be found in offline mode
+func (b *Builder) MissingArtifacts() []string {
+	return b.dl.MissingArtifacts()
+}
+
+// zipFunc builds or fetches a planned zip using the temporary folder dir,
+// sending errors to ch
+type zipFunc func(ctx context.Context, dir string, plan *zipPlan, ch chan error) Status
+
+// run validates cfg, then plans each selected zip and calls fn with the plan,
+// concurrently
+func (b *Builder) run(ctx context.Context, cfg *config.Config, names []string, fn zipFunc) ([]Result, error) {
+	// Catch mistakes before spending time on downloads
+	if errs := cfg.Validate(); len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, fmt.Errorf("The configuration is invalid:\n  %v", strings.Join(msgs, "\n  "))
+	}
+
+	zips, err := cfg.SelectZips(names)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(b.opts.TempDir, "zip-builder-")
+	if err != nil {
+		return nil, fmt.Errorf("Error while creating a temporary directory:\n  %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	results := make([]Result, len(zips))
+	built := make(map[string]bool)
+	for i, zip := range zips {
+		// Zips with the same name would write the same files at once
+		if built[zip.Name] {
+			results[i] = Result{
+				Zip:    zip.Name,
+				Status: StatusFailed,
+				Errors: []error{fmt.Errorf("More than one zip is named %v, only the first one is built", zip.Name)},
+			}
+			continue
+		}
+		built[zip.Name] = true
+		wg.Add(1)
+		go func(i int, zip *lib.ZipInfo) {
+			defer wg.Done()
+			results[i] = collectResult(ctx, zip.Name, func(ch chan error) Status {
+				plan, err := b.planZip(ctx, cfg, zip)
+				if err != nil {
+					ch <- fmt.Errorf("Error while planning %v:\n  %w", zip.Name, err)
+					return StatusFailed
+				}
+				return fn(ctx, dir, plan, ch)
+			})
+			if results[i].Status == StatusFailed && b.opts.FailFast {
+				cancel()
+			}
+		}(i, zip)
+	}
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,191 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// A zip is only rebuilt when its fingerprint changes. The fingerprint covers
+// everything the zip is built from: the parsed configuration of the zip and
+// its apps and files, the SHA-256 of the downloaded files, the files
+// referenced by path and the zip-builder executable itself. It is stored in
+// the manifest of the zip.
+
+var (
+	toolOnce    sync.Once
+	toolVersion string
+)
+
+// toolFingerprint identifies the running zip-builder, so upgrading it rebuilds
+// every zip
+func toolFingerprint() string {
+	toolOnce.Do(func() {
+		toolVersion = "unknown"
+		exe, err := os.Executable()
+		if err != nil {
+			lib.Debug(fmt.Sprintf("COULD NOT FIND EXECUTABLE: %v", err))
+			return
+		}
+		sum, err := lib.GetHash(exe, "sha256")
+		if err != nil {
+			lib.Debug(fmt.Sprintf("COULD NOT HASH EXECUTABLE: %v", err))
+			return
+		}
+		toolVersion = sum
+	})
+	return toolVersion
+}
+
+// fingerprintDownload is what is known about a download before it happens
+type fingerprintDownload struct {
+	label string
+	url   string
+	sums  lib.Checksums
+	info  *lib.FileInfo // FileName is set to the downloaded file
+}
+
+// fingerprintInputs is everything a zip is built from except the contents
+// of its downloads. JSON is used for the plan because it writes maps in
+// sorted order.
+type fingerprintInputs struct {
+	config    bytes.Buffer
+	downloads []fingerprintDownload
+}
+
+func newFingerprintInputs(plan *zipPlan) (*fingerprintInputs, error) {
+	zip := plan.Zip
+	inputs := &fingerprintInputs{}
+	h := &inputs.config
+	fmt.Fprintf(h, "tool %v\n", toolFingerprint())
+
+	modified, err := zipTime()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(h, "time %v\n", modified.Unix())
+
+	config, err := json.Marshal(zip)
+	if err != nil {
+		return nil, fmt.Errorf("Error while encoding zip configuration:\n  %v", err)
+	}
+	fmt.Fprintf(h, "zip %s\n", config)
+
+	for _, app := range plan.Apps {
+		config, err = json.Marshal(app)
+		if err != nil {
+			return nil, fmt.Errorf("Error while encoding configuration of app %v:\n  %v", app.Name, err)
+		}
+		fmt.Fprintf(h, "app %v %s\n", app.Name, config)
+	}
+	for _, file := range plan.Files {
+		config, err = json.Marshal(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error while encoding configuration of file %v:\n  %v", file.Name, err)
+		}
+		fmt.Fprintf(h, "file %v %s\n", file.Name, config)
+	}
+
+	for _, path := range []string{zip.UpdateBinary, zip.SigningKey, zip.SigningCert} {
+		if path == "" {
+			continue
+		}
+		sum, err := lib.GetHash(path, "sha256")
+		if err != nil {
+			return nil, fmt.Errorf("Error while calculating sha256sum of %v:\n  %v", path, err)
+		}
+		fmt.Fprintf(h, "path %v %v\n", path, sum)
+	}
+
+	// F-Droid APKs were resolved while planning, so their URLs and checksums
+	// are known like those of any other download
+	for _, d := range plan.Downloads {
+		kind := "file "
+		if d.Item.App != nil {
+			kind = "app "
+		}
+		url := d.File.Url
+		if d.File.ResolvedUrl != "" {
+			url = d.File.ResolvedUrl
+		}
+		inputs.downloads = append(inputs.downloads, fingerprintDownload{
+			label: kind + d.Item.Name + " " + d.Ver + " " + d.Arch,
+			url:   url,
+			sums:  d.File.Checksums(),
+			info:  d.File})
+	}
+	return inputs, nil
+}
+
+// downloaded reports whether anything is actually downloaded for d
+func (d fingerprintDownload) downloaded() bool {
+	return d.info != nil && d.url != ""
+}
+
+// knownDigest is the SHA-256 of a download, if it is known beforehand
+func (b *Builder) knownDigest(d fingerprintDownload) (string, bool) {
+	return b.dl.KnownDigest(d.url, d.sums)
+}
+
+// fingerprint combines the inputs with the SHA-256 of every download, as
+// returned by digest. It reports false if any of them is not known.
+func (inputs *fingerprintInputs) fingerprint(digest func(fingerprintDownload) (string, bool)) (string, bool) {
+	h := sha256.New()
+	h.Write(inputs.config.Bytes())
+	for _, d := range inputs.downloads {
+		sum := "none"
+		if d.downloaded() {
+			var ok bool
+			sum, ok = digest(d)
+			if !ok {
+				return "", false
+			}
+		}
+		fmt.Fprintf(h, "download %v %v\n", d.label, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// downloadedFingerprint is the fingerprint of a zip whose files have been
+// downloaded into root
+func (inputs *fingerprintInputs) downloadedFingerprint(root string) (string, error) {
+	var err error
+	fingerprint, _ := inputs.fingerprint(func(d fingerprintDownload) (string, bool) {
+		var sum string
+		path := filepath.Join(root, "files", d.info.FileName)
+		sum, err = lib.GetHash(path, "sha256")
+		if err != nil {
+			err = fmt.Errorf("Error while calculating sha256sum of %v:\n  %v", path, err)
+			return "", false
+		}
+		return sum, true
+	})
+	return fingerprint, err
+}
+
+// isUpToDate reports whether the zip named name in the destination folder
+// was built with fingerprint and has not changed since
+func (b *Builder) isUpToDate(name, fingerprint string) bool {
+	zipLocation := filepath.Join(b.opts.Destination, name+".zip")
+	data, err := ioutil.ReadFile(zipLocation + ".json")
+	if err != nil {
+		lib.Debug("NO MANIFEST FOR " + zipLocation)
+		return false
+	}
+	var manifest Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil || manifest.Fingerprint != fingerprint {
+		lib.Debug("FINGERPRINT CHANGED FOR " + zipLocation)
+		return false
+	}
+	sum, err := lib.GetHash(zipLocation, "sha256")
+	return err == nil && sum == manifest.SHA256
+}
@@ -0,0 +1,59 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+func TestFingerprintBeforeDownload(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("downloaded apk")
+	if err := ioutil.WriteFile(filepath.Join(root, "files", "app.apk"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	const otherDigest = "ad5c6a5ab07f5b4bd4e3fa64d1c3b8c4d74acdc8ba3a18b5fcb04ad3cf5d6baa"
+	sum, err := lib.GetHash(filepath.Join(root, "files", "app.apk"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(Options{})
+	inputs := &fingerprintInputs{}
+	inputs.config.WriteString("zip test\n")
+	inputs.downloads = []fingerprintDownload{
+		{label: "app pinned", url: "https://example.com/app.apk", sums: lib.Checksums{SHA256: sum},
+			info: &lib.FileInfo{FileName: "app.apk"}},
+		{label: "file without url", info: &lib.FileInfo{}}}
+
+	before, known := inputs.fingerprint(b.knownDigest)
+	if !known {
+		t.Fatal("fingerprint with pinned SHA-256 is not known before downloading")
+	}
+	after, err := inputs.downloadedFingerprint(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("fingerprint before downloading is %v, after %v", before, after)
+	}
+
+	// A different download gives a different fingerprint
+	inputs.downloads[0].sums.SHA256 = otherDigest
+	if changed, _ := inputs.fingerprint(b.knownDigest); changed == before {
+		t.Error("fingerprint did not change with the pinned SHA-256")
+	}
+
+	// Without a pinned SHA-256 or a cache, a download is only known once it
+	// is downloaded
+	inputs.downloads[0].sums = lib.Checksums{}
+	if _, known := inputs.fingerprint(b.knownDigest); known {
+		t.Error("fingerprint of an unpinned download is known before downloading")
+	}
+}
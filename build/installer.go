@@ -0,0 +1,190 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// installerDialect writes the statements of an installer script, so the same
+// apps and files can be installed by an edify updater-script, by a shell
+// update-binary or by the customize.sh of a Magisk module
+type installerDialect interface {
+	// header mounts the partitions and detects the device
+	header(partitions []string, buffer *bytes.Buffer)
+	// footer unmounts the partitions
+	footer(partitions []string, buffer *bytes.Buffer)
+	print(msg string, buffer *bytes.Buffer)
+	beginIf(cond string, buffer *bytes.Buffer)
+	endIf(buffer *bytes.Buffer)
+	// versionTest matches API levels between min and max, inclusive
+	versionTest(min, max int) string
+	// abiTest matches devices that support abi
+	abiTest(abi string) string
+	// dirTest matches if path is an existing directory
+	dirTest(path string) string
+	// tryMount mounts a partition without failing if it cannot be mounted
+	tryMount(part string, buffer *bytes.Buffer)
+	installFile(file *lib.FileInfo, buffer *bytes.Buffer)
+	deleteFile(path string, buffer *bytes.Buffer)
+	// write saves the script and whatever else runs it into the zip
+	write(root string, script []byte) error
+}
+
+func dialectFor(zip *lib.ZipInfo) installerDialect {
+	if zip.Output == lib.OutputMagisk {
+		return magiskDialect{zip}
+	}
+	if zip.Installer == lib.InstallerShell {
+		return shellDialect{}
+	}
+	return edifyDialect{}
+}
+
+func makeFileDeleteScriptlet(d installerDialect, filesToDelete map[string]bool, buffer *bytes.Buffer) {
+	for _, file := range lib.SortedKeys(filesToDelete) {
+		d.deleteFile(file, buffer)
+	}
+}
+
+func processInstallFile(d installerDialect, item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo, ver string, extractFiles *bytes.Buffer, verFilesToDelete *map[string]bool) {
+	if !item[ver].HasArchSpecificInfo {
+		if item[ver].Arch[lib.NOARCH].FileName != "" {
+			lib.Debug("INSTALLING: " + item[ver].Arch[lib.NOARCH].FileName)
+			d.installFile(item[ver].Arch[lib.NOARCH], extractFiles)
+			for _, del := range item[ver].Arch[lib.NOARCH].InstallRemoveFiles {
+				lib.Debug("DELETE FILE (VERSION): " + del)
+				(*verFilesToDelete)[del] = true
+			}
+		}
+	} else {
+		for _, arch := range lib.Arches {
+			if item[ver].Arch[arch] != nil && item[ver].Arch[arch].FileName != "" {
+				lib.Debug("TESTING FOR ANDROID ARCH: " + arch)
+				abi := arch
+				if arch == "arm" {
+					abi = "armeabi"
+				}
+				d.beginIf(d.abiTest(abi), extractFiles)
+
+				archFilesToDelete := make(map[string]bool)
+				// Add any files that this app wants deleted
+				for _, del := range item[ver].Arch[arch].InstallRemoveFiles {
+					lib.Debug("DELETE FILE (ARCH): " + del)
+					archFilesToDelete[del] = true
+				}
+				makeFileDeleteScriptlet(d, archFilesToDelete, extractFiles)
+
+				lib.Debug("INSTALLING ITEM: " + item[ver].Arch[arch].FileName)
+				d.installFile(item[ver].Arch[arch], extractFiles)
+				d.endIf(extractFiles)
+			}
+		}
+	}
+}
+
+func makePerItemScriptlet(d installerDialect, item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo, versions *lib.VersionTable, buff *bytes.Buffer) {
+	// Consecutive versions that share the same base share the same files, so
+	// each run of them is installed under a single API level range
+	var base, first, last string
+	flush := func() {
+		if base == "" {
+			return
+		}
+		verFilesToDelete := make(map[string]bool)
+		var extractFiles bytes.Buffer
+		var deleteFiles bytes.Buffer
+		processInstallFile(d, item, zip, first, &extractFiles, &verFilesToDelete)
+		makeFileDeleteScriptlet(d, verFilesToDelete, &deleteFiles)
+		if deleteFiles.Len() > 0 || extractFiles.Len() > 0 {
+			d.beginIf(d.versionTest(versions.SdkLevel(first), versions.SdkLevel(last)), buff)
+			buff.WriteString(deleteFiles.String())
+			buff.WriteString(extractFiles.String())
+			d.endIf(buff)
+		}
+		base = ""
+	}
+
+	for _, ver := range zip.Versions {
+		lib.Debug("ANDROID VERSION: " + ver)
+		if item[ver] == nil || item[ver].Base == "" {
+			flush()
+			continue
+		}
+		if item[ver].Base != base {
+			flush()
+			base = item[ver].Base
+			first = ver
+		}
+		last = ver
+	}
+	flush()
+}
+
+func makeInstallScript(z *zipBuild) error {
+	zip := z.Plan.Zip
+	d := dialectFor(zip)
+	if zip.Output == lib.OutputMagisk {
+		fmt.Println("Generating Magisk module")
+	} else {
+		fmt.Println("Generating " + zip.Installer + " installer script")
+	}
+
+	var script bytes.Buffer
+
+	partitions := zipPartitions(z)
+	d.header(partitions, &script)
+
+	filesToDelete := make(map[string]bool)
+	for _, del := range zip.InstallRemoveFiles {
+		filesToDelete[del] = true
+	}
+	makeFileDeleteScriptlet(d, filesToDelete, &script)
+
+	for _, app := range z.Plan.Apps {
+		if app.App.PackageName != "" {
+			makePerItemScriptlet(d, app.Version, zip, z.Plan.Versions, &script)
+		}
+	}
+
+	var giveWarning bool
+	for _, file := range z.files() {
+		makePerItemScriptlet(d, file.Version, zip, z.Plan.Versions, &script)
+
+		giveWarning = giveWarning || file.Name == "permissions.xml" || file.Name == "sysconfig.xml"
+	}
+
+	if giveWarning {
+		// Only needed for the warning, so failing to mount is not fatal
+		hasData := false
+		for _, part := range partitions {
+			hasData = hasData || part == "/data"
+		}
+		if !hasData {
+			d.tryMount("/data", &script)
+			partitions = append(partitions, "/data")
+		}
+		d.beginIf(d.dirTest("/data/data"), &script)
+		for _, line := range []string{
+			"---",
+			"|- WARNING:",
+			"|- It appears you have previously booted",
+			"|- into this system. This zip includes a",
+			"|- set of permissions to grant to installed",
+			"|- apps by default, however default",
+			"|- permissions are only applied on FIRST",
+			"|- boot. You will need to manually grant",
+			"|- permissions to these apps.",
+			"---"} {
+			d.print(line, &script)
+		}
+		d.endIf(&script)
+	}
+
+	d.footer(partitions, &script)
+	d.print("Done!", &script)
+	d.print("--------------------------------------", &script)
+
+	return d.write(z.Root, script.Bytes())
+}
@@ -0,0 +1,205 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Magisk modules are installed by Magisk itself, which sources customize.sh
+// with $MODPATH set to the module folder. Files are copied into the system/
+// mirror inside it instead of the real partitions, which Magisk overlays at
+// boot. Because the versions and architectures of the device are only known
+// when installing, customize.sh picks the files the same way the recovery
+// installers do.
+
+// The module installer shipped in Magisk's module template. The Magisk app
+// runs it from Android, where the shell is /system/bin/sh.
+const magiskUpdateBinary = `#!/system/bin/sh
+
+#################
+# Initialization
+#################
+
+umask 022
+
+# echo before loading util_functions
+ui_print() { echo "$1"; }
+
+require_new_magisk() {
+  ui_print "*******************************"
+  ui_print " Please install Magisk v20.4+! "
+  ui_print "*******************************"
+  exit 1
+}
+
+#########################
+# Load util_functions.sh
+#########################
+
+OUTFD=$2
+ZIPFILE=$3
+
+mount /data 2>/dev/null
+
+[ -f /data/adb/magisk/util_functions.sh ] || require_new_magisk
+. /data/adb/magisk/util_functions.sh
+[ $MAGISK_VER_CODE -lt 20400 ] && require_new_magisk
+
+install_module
+exit 0
+`
+
+const magiskUninstall = `#!/system/bin/sh
+#
+# This uninstall script was automatically generated by zip-builder
+#
+# Everything the module installs is systemless and is removed by Magisk
+# together with the module folder, so there is nothing else to clean up.
+#
+`
+
+// magiskDialect generates the customize.sh of a Magisk module
+type magiskDialect struct {
+	zip *lib.ZipInfo
+}
+
+// overlayPath returns where a file installed to dest goes inside the module
+func overlayPath(dest string) string {
+	if rel := lib.SystemRelative(dest); rel != "" {
+		return "$MODPATH/system/" + rel
+	}
+	return ""
+}
+
+func (magiskDialect) header(partitions []string, buffer *bytes.Buffer) {
+	buffer.WriteString(`#
+# This customize.sh was automatically generated by zip-builder
+#
+
+SKIPUNZIP=1
+SDK=$API
+ABILIST="$(getprop ro.product.cpu.abilist) $(getprop ro.product.cpu.abi)"
+ui_print "--------------------------------------"
+ui_print "Detected Android version: $(getprop ro.build.version.release) (SDK $SDK)"
+ui_print "Detected arch: $ABILIST"
+unzip -o "$ZIPFILE" module.prop uninstall.sh -d "$MODPATH" >&2
+rm -f "$TMPDIR/modes"
+`)
+}
+
+// Magisk skips setting permissions when SKIPUNZIP is set, so the defaults are
+// applied here and then the mode of each installed file
+func (magiskDialect) footer(partitions []string, buffer *bytes.Buffer) {
+	buffer.WriteString(`set_perm_recursive "$MODPATH" 0 0 0755 0644
+if [ -f "$TMPDIR/modes" ]; then
+  while read MODE FILE; do
+    set_perm "$FILE" 0 0 "$MODE"
+  done < "$TMPDIR/modes"
+fi
+`)
+}
+
+func (magiskDialect) print(msg string, buffer *bytes.Buffer) {
+	shellDialect{}.print(msg, buffer)
+}
+
+func (magiskDialect) beginIf(cond string, buffer *bytes.Buffer) {
+	shellDialect{}.beginIf(cond, buffer)
+}
+
+func (magiskDialect) endIf(buffer *bytes.Buffer) {
+	shellDialect{}.endIf(buffer)
+}
+
+func (magiskDialect) versionTest(min, max int) string {
+	return shellDialect{}.versionTest(min, max)
+}
+
+func (magiskDialect) abiTest(abi string) string {
+	return shellDialect{}.abiTest(abi)
+}
+
+func (magiskDialect) dirTest(path string) string {
+	return shellDialect{}.dirTest(path)
+}
+
+// Magisk has already mounted everything it needs
+func (magiskDialect) tryMount(part string, buffer *bytes.Buffer) {}
+
+func (magiskDialect) installFile(file *lib.FileInfo, buffer *bytes.Buffer) {
+	dest := overlayPath(file.Destination)
+	if dest == "" {
+		buffer.WriteString("ui_print " + quote("Skipping "+file.Destination+", Magisk modules can only install to system partitions") + "\n")
+		return
+	}
+	// The module path is expanded by the shell, the rest is quoted
+	quoted := "\"$MODPATH\"" + quote(strings.TrimPrefix(dest, "$MODPATH"))
+	buffer.WriteString("mkdir -p \"$(dirname " + quoted + ")\"\n")
+	buffer.WriteString("ui_print " + quote("Extracting "+file.Destination) + "\n")
+	buffer.WriteString("unzip -p \"$ZIPFILE\" " + quote("files/"+file.FileName) + " > " + quoted +
+		" || abort " + quote("E: Could not extract "+file.Destination) + "\n")
+	buffer.WriteString("echo " + file.Mode + " " + quoted + " >> \"$TMPDIR/modes\"\n")
+}
+
+// Files cannot be deleted from a systemless module. Folders are hidden with a
+// .replace marker and files with the character device Magisk treats as a
+// whiteout.
+func (magiskDialect) deleteFile(file string, buffer *bytes.Buffer) {
+	dest := overlayPath(file)
+	if dest == "" {
+		return
+	}
+	quoted := "\"$MODPATH\"" + quote(strings.TrimPrefix(dest, "$MODPATH"))
+	path := quote(file)
+	buffer.WriteString("if [ -d " + path + " ]; then\n")
+	buffer.WriteString("  ui_print " + quote("Replacing existing folder "+file) + "\n")
+	buffer.WriteString("  mkdir -p " + quoted + " && touch " + quoted + "/.replace\n")
+	buffer.WriteString("elif [ -f " + path + " ]; then\n")
+	buffer.WriteString("  ui_print " + quote("Hiding existing file "+file) + "\n")
+	buffer.WriteString("  mkdir -p \"$(dirname " + quoted + ")\" && mknod " + quoted + " c 0 0\n")
+	buffer.WriteString("fi\n")
+}
+
+func (d magiskDialect) moduleProp() string {
+	var buf bytes.Buffer
+	buf.WriteString("id=" + d.zip.ModuleId + "\n")
+	buf.WriteString("name=" + d.zip.Name + "\n")
+	buf.WriteString("version=" + d.zip.ModuleVersion + "\n")
+	buf.WriteString("versionCode=" + strconv.Itoa(d.zip.ModuleVersionCode) + "\n")
+	buf.WriteString("author=" + d.zip.ModuleAuthor + "\n")
+	buf.WriteString("description=" + d.zip.ModuleDescription + "\n")
+	return buf.String()
+}
+
+func (d magiskDialect) write(root string, script []byte) error {
+	scriptDest := filepath.Join(root, "/META-INF/com/google/android")
+	err := os.MkdirAll(scriptDest, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", scriptDest, err)
+	}
+
+	toWrite := []struct {
+		Path string
+		Data []byte
+		Mode os.FileMode
+	}{
+		{filepath.Join(scriptDest, "update-binary"), []byte(magiskUpdateBinary), 0755},
+		{filepath.Join(scriptDest, "updater-script"), []byte("#MAGISK\n"), 0644},
+		{filepath.Join(root, "customize.sh"), script, 0644},
+		{filepath.Join(root, "uninstall.sh"), []byte(magiskUninstall), 0644},
+		{filepath.Join(root, "module.prop"), []byte(d.moduleProp()), 0644}}
+	for _, file := range toWrite {
+		err = ioutil.WriteFile(file.Path, file.Data, file.Mode)
+		if err != nil {
+			return fmt.Errorf("Error while writing %v:\n  %v", file.Path, err)
+		}
+	}
+	return nil
+}
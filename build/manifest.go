@@ -0,0 +1,177 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Manifest describes a built zip. It is written as JSON next to the zip, so
+// download sites and update checkers do not need to parse the build output.
+type Manifest struct {
+	Name         string          `json:"name"`
+	File         string          `json:"file"`
+	Size         int64           `json:"size"`
+	SHA256       string          `json:"sha256"`
+	SignerSHA256 string          `json:"signer_sha256,omitempty"` // Empty if the zip is not signed
+	Fingerprint  string          `json:"fingerprint"`             // Of the inputs of the zip, see fingerprintInputs
+	Output       string          `json:"output"`
+	Installer    string          `json:"installer,omitempty"`
+	Versions     []string        `json:"android_versions"`
+	Arches       []string        `json:"arches"`
+	Apps         []ManifestEntry `json:"apps,omitempty"`
+	Files        []ManifestEntry `json:"files,omitempty"`
+	Removes      []string        `json:"removes,omitempty"` // Only for uninstallers
+}
+
+// ManifestEntry is an app or file of the zip
+type ManifestEntry struct {
+	Name        string         `json:"name"`
+	PackageName string         `json:"package_name,omitempty"`
+	Generated   bool           `json:"generated,omitempty"` // Made while building instead of downloaded
+	Items       []ManifestItem `json:"items"`
+}
+
+// ManifestItem is what an app or file installs on one Android version and
+// architecture
+type ManifestItem struct {
+	AndroidVersion string `json:"android_version"`
+	Arch           string `json:"arch"`
+	Source         string `json:"source,omitempty"`
+	Version        string `json:"version,omitempty"`
+	VersionCode    int    `json:"version_code,omitempty"`
+	SHA256         string `json:"sha256"`
+	Destination    string `json:"destination"`
+}
+
+// manifestItems lists what item installs on each version and architecture of
+// the zip. Checksums are read from the files in the zip root and cached in
+// sums, since versions often share files.
+func manifestItems(z *zipBuild, item map[string]*lib.AndroidVersionInfo, sums map[string]string) ([]ManifestItem, error) {
+	zip := z.Plan.Zip
+	var items []ManifestItem
+	for _, ver := range zip.Versions {
+		if item[ver] == nil {
+			continue
+		}
+		for _, arch := range append([]string{lib.NOARCH}, zip.Arches...) {
+			file := item[ver].Arch[arch]
+			if file == nil || file.FileName == "" {
+				continue
+			}
+
+			sum, ok := sums[file.FileName]
+			if !ok {
+				var err error
+				sum, err = lib.GetHash(filepath.Join(z.Root, "files", file.FileName), "sha256")
+				if err != nil {
+					return nil, fmt.Errorf("Error while calculating sha256sum of %v:\n  %v", file.FileName, err)
+				}
+				sums[file.FileName] = sum
+			}
+
+			source := file.ResolvedUrl
+			if source == "" {
+				source = file.Url
+			}
+			version, versionCode := z.resolvedVersion(file)
+			if version == "" {
+				version = file.Version
+			}
+			items = append(items, ManifestItem{
+				AndroidVersion: ver,
+				Arch:           arch,
+				Source:         source,
+				Version:        version,
+				VersionCode:    versionCode,
+				SHA256:         sum,
+				Destination:    file.Destination})
+		}
+	}
+	return items, nil
+}
+
+// newManifest describes the zip at zipLocation
+func newManifest(zipLocation, signer, fingerprint string, zip *lib.ZipInfo) (*Manifest, error) {
+	info, err := os.Stat(zipLocation)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading size of %v:\n  %v", zipLocation, err)
+	}
+	sum, err := lib.GetHash(zipLocation, "sha256")
+	if err != nil {
+		return nil, fmt.Errorf("Error while calculating sha256sum of %v:\n  %v", zipLocation, err)
+	}
+
+	manifest := &Manifest{
+		Name:         zip.Name,
+		File:         filepath.Base(zipLocation),
+		Size:         info.Size(),
+		SHA256:       sum,
+		SignerSHA256: signer,
+		Fingerprint:  fingerprint,
+		Output:       zip.Output,
+		Versions:     zip.Versions,
+		Arches:       zip.Arches}
+	if zip.Output != lib.OutputMagisk {
+		manifest.Installer = zip.Installer
+	}
+	return manifest, nil
+}
+
+// writeManifest saves the manifest as <zip>.json
+func writeManifest(zipLocation string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error while encoding manifest of %v:\n  %v", zipLocation, err)
+	}
+	dest := zipLocation + ".json"
+	err = ioutil.WriteFile(dest, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("Error while writing manifest to %v:\n  %v", dest, err)
+	}
+	return nil
+}
+
+// makeManifest writes the manifest of a zip
+func makeManifest(z *zipBuild, zipLocation, signer, fingerprint string) error {
+	fmt.Println("Generating manifest for " + zipLocation)
+	manifest, err := newManifest(zipLocation, signer, fingerprint, z.Plan.Zip)
+	if err != nil {
+		return err
+	}
+
+	sums := make(map[string]string)
+	for _, app := range z.Plan.Apps {
+		if app.App.PackageName == "" {
+			continue
+		}
+		items, err := manifestItems(z, app.Version, sums)
+		if err != nil {
+			return fmt.Errorf("Error while listing app %v:\n  %v", app.Name, err)
+		}
+		manifest.Apps = append(manifest.Apps, ManifestEntry{Name: app.Name, PackageName: app.App.PackageName, Items: items})
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range z.files() {
+		if seen[file.Name] {
+			continue
+		}
+		seen[file.Name] = true
+		items, err := manifestItems(z, file.Version, sums)
+		if err != nil {
+			return fmt.Errorf("Error while listing file %v:\n  %v", file.Name, err)
+		}
+		generated := true
+		for _, item := range items {
+			generated = generated && item.Source == ""
+		}
+		manifest.Files = append(manifest.Files, ManifestEntry{Name: file.Name, Generated: generated, Items: items})
+	}
+
+	return writeManifest(zipLocation, manifest)
+}
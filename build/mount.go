@@ -0,0 +1,77 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/Shadow53/zip-builder"
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+const mountScript = "/tmp/mount-partitions.sh"
+
+// writeMountScript places the partition mounting helper into META-INF
+func writeMountScript(root string) error {
+	dest := filepath.Join(root, "META-INF", "com", "google", "android")
+	err := os.MkdirAll(dest, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", dest, err)
+	}
+	dest = filepath.Join(dest, "mount-partitions.sh")
+
+	err = ioutil.WriteFile(dest, zipbuilder.MountScript, 0755)
+	if err != nil {
+		return fmt.Errorf("Error while writing mount script to %v:\n  %v", dest, err)
+	}
+	return nil
+}
+
+func addPartitions(item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo, parts map[string]bool) {
+	for _, ver := range zip.Versions {
+		if item[ver] == nil {
+			continue
+		}
+		for _, file := range item[ver].Arch {
+			if file == nil {
+				continue
+			}
+			parts[lib.PartitionOf(file.Destination)] = true
+			for _, del := range file.InstallRemoveFiles {
+				parts[lib.PartitionOf(del)] = true
+			}
+		}
+	}
+}
+
+// zipPartitions returns the partitions the zip installs to or removes files
+// from, in the order of lib.Partitions. /system is always included because
+// the Android version is read from its build.prop.
+func zipPartitions(z *zipBuild) []string {
+	zip := z.Plan.Zip
+	parts := map[string]bool{"/system": true}
+	for _, del := range zip.InstallRemoveFiles {
+		parts[lib.PartitionOf(del)] = true
+	}
+
+	for _, app := range z.Plan.Apps {
+		addPartitions(app.Version, zip, parts)
+	}
+	for _, file := range z.files() {
+		addPartitions(file.Version, zip, parts)
+	}
+
+	var partitions []string
+	for _, part := range lib.Partitions {
+		if parts[part] {
+			partitions = append(partitions, part)
+		}
+	}
+	return partitions
+}
+
+// mountError is shown when a partition cannot be mounted read-write
+func mountError(part string) string {
+	return "E: Could not mount " + part + " read-write. Make sure the partition exists, disable dm-verity if needed, and use a recovery that supports this device."
+}
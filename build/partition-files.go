@@ -0,0 +1,111 @@
+package build
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Android only reads the permissions and sysconfig files of a partition for
+// the apps installed to that partition, so generated files are split by the
+// partition each app is installed to.
+
+// appPartition returns the system partition an app is installed to in the
+// zip, defaulting to /system for apps installed to /data
+func appPartition(app *planItem, zip *lib.ZipInfo) string {
+	for _, ver := range zip.Versions {
+		if app.Version[ver] == nil {
+			continue
+		}
+		for _, arch := range append([]string{lib.NOARCH}, zip.Arches...) {
+			if file := app.Version[ver].Arch[arch]; file != nil {
+				if part := lib.PartitionOf(file.Destination); lib.IsSystemPartition(part) {
+					return part
+				}
+			}
+		}
+	}
+	return "/system"
+}
+
+// appsByPartition groups the apps of a zip by the partition they install to
+func appsByPartition(plan *zipPlan) map[string][]*planItem {
+	byPartition := make(map[string][]*planItem)
+	for _, app := range plan.Apps {
+		if app.App.PackageName != "" {
+			part := appPartition(app, plan.Zip)
+			byPartition[part] = append(byPartition[part], app)
+		}
+	}
+	return byPartition
+}
+
+// partitionSuffix tells apart the files generated for each partition. Files
+// for /system keep the names they had before other partitions were supported.
+func partitionSuffix(part string) string {
+	if part == "/system" {
+		return ""
+	}
+	return "-" + part[1:]
+}
+
+// generatedFileVersions installs a generated file on every version of the zip
+// that one of the apps is installed on, starting at minVersion
+func generatedFileVersions(plan *zipPlan, apps []*planItem, fileInfo *lib.FileInfo, minVersion string) map[string]*lib.AndroidVersionInfo {
+	versions := make(map[string]*lib.AndroidVersionInfo)
+	var base string
+	for _, ver := range plan.Zip.Versions {
+		if plan.Versions.SdkLevel(ver) < plan.Versions.SdkLevel(minVersion) {
+			continue
+		}
+		for _, app := range apps {
+			if app.Version[ver] != nil {
+				if base == "" {
+					base = ver
+				}
+				versions[ver] = &lib.AndroidVersionInfo{
+					Arch: map[string]*lib.FileInfo{lib.NOARCH: fileInfo},
+					Base: base}
+				break
+			}
+		}
+	}
+	return versions
+}
+
+// writeGeneratedXML writes data to files/<fileInfo.FileName> and adds it to
+// the files of the zip under fileId
+func writeGeneratedXML(z *zipBuild, fileId string, fileInfo *lib.FileInfo,
+	versions map[string]*lib.AndroidVersionInfo, data interface{}) error {
+	fileDest := filepath.Join(z.Root, "files")
+	err := os.MkdirAll(fileDest, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", fileDest, err)
+	}
+	fileDest = filepath.Join(fileDest, fileInfo.FileName)
+
+	file, err := os.Create(fileDest)
+	if err != nil {
+		return fmt.Errorf("Error while creating file %v:\n  %v", fileDest, err)
+	}
+	defer file.Close()
+
+	_, err = file.Write([]byte(xml.Header))
+	if err != nil {
+		return fmt.Errorf("Error while writing XML header to %v:\n  %v", fileDest, err)
+	}
+
+	enc := xml.NewEncoder(file)
+	enc.Indent("", "    ")
+	err = enc.Encode(data)
+	if err != nil {
+		return fmt.Errorf("Error while writing XML to %v:\n  %v", fileDest, err)
+	}
+
+	// File was created, add to files list for install/addon.d backup
+	z.Extra = append(z.Extra, &planItem{Name: fileId, Version: versions})
+	return nil
+}
@@ -3,8 +3,6 @@ package build
 import (
 	"encoding/xml"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
 
 	"gitlab.com/Shadow53/zip-builder/lib"
@@ -27,112 +25,76 @@ type Permissions struct {
 	Apps    []PermissionApp `xml:"exception"`
 }
 
-// Permissions file is not Android version-specific because any permissions
-// or apps not found should end up ignored
-func makePermsFile(root string, zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files) error {
-	var exceptions Permissions
-	permissionFile := make(map[string]*lib.AndroidVersionInfo)
-
-	zip.Mux.RLock()
-	fileInfo := lib.FileInfo{
-		Destination: "/system/etc/default-permissions/" + zip.Name + "-permissions.xml",
-		Mode:        "0644",
-		FileName:    "permissions.xml"}
-	zip.Mux.RUnlock()
-
-	// Generate path to permissions file
-	fileDest := filepath.Join(root, "files")
-	err := os.MkdirAll(fileDest, os.ModeDir|0755)
-	if err != nil {
-		return fmt.Errorf("Error while creating directory %v:\n  %v", fileDest, err)
+// normalizePermission adds the android.permission. prefix to permissions
+// configured by their short name
+func normalizePermission(perm string) string {
+	if strings.Index(perm, ".") < 0 {
+		return "android.permission." + perm
 	}
-	fileDest = filepath.Join(fileDest, "permissions.xml")
-
-	zip.RLock()
-	zipApps := zip.Apps
-	zip.RUnlock()
-	for _, app := range zipApps {
-		packageName := ""
-		var permissions []string = nil
-		apps.RLock()
-		if apps.AppExists(app) {
-			apps.RLockApp(app)
-			packageName = apps.App[app].PackageName
-			permissions = apps.App[app].Permissions
-			apps.RUnlockApp(app)
-		}
-		apps.RUnlock()
+	return perm
+}
 
-		if packageName != "" {
-			perms := PermissionApp{Name: packageName}
-			for _, perm := range permissions {
-				if strings.Index(perm, ".") < 0 {
-					perm = "android.permission." + perm
-				}
-				perms.Permissions = append(perms.Permissions, Permission{Name: perm})
+// appPermissions combines the configured permissions of an app with the ones
+// requested by the APKs downloaded for the zip
+func appPermissions(z *zipBuild, app *planItem) []string {
+	var permissions []string
+	seen := make(map[string]bool)
+	add := func(perms []string) {
+		for _, perm := range perms {
+			perm = normalizePermission(perm)
+			if !seen[perm] {
+				seen[perm] = true
+				permissions = append(permissions, perm)
 			}
-			exceptions.Apps = append(exceptions.Apps, perms)
 		}
 	}
 
-	var minVersion string
+	add(app.App.Permissions)
+	zip := z.Plan.Zip
 	for _, ver := range zip.Versions {
-		for _, app := range zipApps {
-			apps.RLockApp(app)
-			if apps.AppVersionExists(app, ver) {
-				apps.RLockAppVersion(app, ver)
-				if minVersion == "" && apps.GetAppVersion(app, ver).Base == ver {
-					minVersion = ver
-				}
-				apps.RUnlockAppVersion(app, ver)
-				if minVersion != "" {
-					permissionFile[ver] = &lib.AndroidVersionInfo{
-						Arch: make(map[string]*lib.FileInfo),
-						Base: minVersion}
-					// Only need to set this because is not arch-specific, will be reached first
-					permissionFile[ver].Arch[lib.NOARCH] = &fileInfo
+		if app.Version[ver] != nil {
+			for _, arch := range append([]string{lib.NOARCH}, zip.Arches...) {
+				if file := app.Version[ver].Arch[arch]; file != nil {
+					add(z.filePermissions(app, file))
 				}
 			}
-			apps.RUnlockApp(app)
 		}
 	}
+	return permissions
+}
 
-	if len(exceptions.Apps) > 0 {
-		fmt.Println("Generating permissions file for " + zip.Name)
-
-		file, err := os.Create(fileDest)
-		if err != nil {
-			return fmt.Errorf("Error while creating file %v:\n  %v", fileDest, err)
+// Permissions file is not Android version-specific because any permissions
+// or apps not found should end up ignored
+func makePermsFile(z *zipBuild) error {
+	zip := z.Plan.Zip
+	byPartition := appsByPartition(z.Plan)
+	for _, part := range lib.Partitions {
+		partApps := byPartition[part]
+		if len(partApps) == 0 {
+			continue
 		}
-		defer file.Close()
 
-		_, err = file.Write([]byte(xml.Header))
-		if err != nil {
-			return fmt.Errorf("Error while writing XML header to file %v:\n  %v", fileDest, err)
+		var exceptions Permissions
+		for _, app := range partApps {
+			perms := PermissionApp{Name: app.App.PackageName}
+			for _, perm := range appPermissions(z, app) {
+				perms.Permissions = append(perms.Permissions, Permission{Name: perm})
+			}
+			exceptions.Apps = append(exceptions.Apps, perms)
 		}
 
-		enc := xml.NewEncoder(file)
-		enc.Indent("", "    ")
-		err = enc.Encode(exceptions)
+		fileInfo := lib.FileInfo{
+			Destination: part + "/etc/default-permissions/" + zip.Name + "-permissions.xml",
+			Mode:        "0644",
+			FileName:    "permissions" + partitionSuffix(part) + ".xml"}
+		fileId := zip.Name + partitionSuffix(part) + "-permissions.xml"
+		fmt.Println("Generating permissions file for " + zip.Name + " on " + part)
+
+		err := writeGeneratedXML(z, fileId, &fileInfo,
+			generatedFileVersions(z.Plan, partApps, &fileInfo, zip.Versions[0]), exceptions)
 		if err != nil {
-			return fmt.Errorf("Error while writing permissions XML to %v:\n  %v", fileDest, err)
+			return err
 		}
-
-		// File was created, add to files list for install/addon.d backup
-		zip.RLock()
-		fileId := zip.Name + "-permissions.xml"
-		zip.RUnlock()
-		files.Lock()
-		files.SetFile(fileId, &lib.AndroidVersions{})
-		files.Unlock()
-
-		files.LockFile(fileId)
-		files.GetFile(fileId).Version = permissionFile
-		files.UnlockFile(fileId)
-
-		zip.Lock()
-		zip.Files = append(zip.Files, fileId)
-		zip.Unlock()
 	}
 	return nil
 }
@@ -205,104 +167,52 @@ type SysConfig struct {
 	DataSaverWhitelist      []DataSaverWhitelist      `xml:"allow-in-data-usage-save"`
 }
 
-func makeSysconfigFile(root string, zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files) error {
-	var sysconfig SysConfig
-	sysconfigFile := make(map[string]*lib.AndroidVersionInfo)
-	zip.RLock()
-	fileInfo := lib.FileInfo{
-		Destination: "/system/etc/sysconfig/" + zip.Name + ".xml",
-		Mode:        "0644",
-		FileName:    "sysconfig.xml"}
-	zipApps := zip.Apps
-	zip.RUnlock()
+func makeSysconfigFile(z *zipBuild) error {
+	zip := z.Plan.Zip
+	byPartition := appsByPartition(z.Plan)
+	for _, part := range lib.Partitions {
+		partApps := byPartition[part]
+		if len(partApps) == 0 {
+			continue
+		}
 
-	for _, app := range zipApps {
-		apps.RLockApp(app)
-		if apps.GetApp(app).PackageName != "" {
-			if apps.GetApp(app).DozeWhitelist {
-				sysconfig.DozeWhitelist = append(sysconfig.DozeWhitelist, DozeWhitelist{Package: apps.GetApp(app).PackageName})
+		var sysconfig SysConfig
+		for _, item := range partApps {
+			app := item.App
+			if app.DozeWhitelist {
+				sysconfig.DozeWhitelist = append(sysconfig.DozeWhitelist, DozeWhitelist{Package: app.PackageName})
 			}
-			if apps.GetApp(app).DozeWhitelistExceptIdle {
-				sysconfig.DozeWhitelistExceptIdle = append(sysconfig.DozeWhitelistExceptIdle, DozeWhitelistExceptIdle{Package: apps.GetApp(app).PackageName})
+			if app.DozeWhitelistExceptIdle {
+				sysconfig.DozeWhitelistExceptIdle = append(sysconfig.DozeWhitelistExceptIdle, DozeWhitelistExceptIdle{Package: app.PackageName})
 			}
-			if apps.GetApp(app).DataSaverWhitelist {
-				sysconfig.DataSaverWhitelist = append(sysconfig.DataSaverWhitelist, DataSaverWhitelist{Package: apps.GetApp(app).PackageName})
+			if app.DataSaverWhitelist {
+				sysconfig.DataSaverWhitelist = append(sysconfig.DataSaverWhitelist, DataSaverWhitelist{Package: app.PackageName})
 			}
-			if apps.GetApp(app).AllowSystemUser {
-				sysconfig.SystemWhitelist = append(sysconfig.SystemWhitelist, SystemWhitelistUser{Package: apps.GetApp(app).PackageName})
+			if app.AllowSystemUser {
+				sysconfig.SystemWhitelist = append(sysconfig.SystemWhitelist, SystemWhitelistUser{Package: app.PackageName})
 			}
-			if apps.GetApp(app).BlacklistSystemUser {
-				sysconfig.SystemBlacklist = append(sysconfig.SystemBlacklist, SystemBlacklistUser{Package: apps.GetApp(app).PackageName})
+			if app.BlacklistSystemUser {
+				sysconfig.SystemBlacklist = append(sysconfig.SystemBlacklist, SystemBlacklistUser{Package: app.PackageName})
 			}
 		}
-		apps.RUnlockApp(app)
-	}
 
-	var minVersion string
-	for _, ver := range zip.Versions {
-		for _, app := range zipApps {
-			apps.RLockApp(app)
-			if apps.AppVersionExists(app, ver) {
-				apps.RLockAppVersion(app, ver)
-				if minVersion == "" && apps.GetAppVersion(app, ver).Base == ver {
-					minVersion = ver
-				}
-				apps.RUnlockAppVersion(app, ver)
-				if minVersion != "" {
-					sysconfigFile[ver] = &lib.AndroidVersionInfo{
-						Arch: make(map[string]*lib.FileInfo),
-						Base: minVersion}
-					sysconfigFile[ver].Arch[lib.NOARCH] = &fileInfo
-				}
-			}
-			apps.RUnlockApp(app)
+		if len(sysconfig.DozeWhitelist) == 0 && len(sysconfig.DozeWhitelistExceptIdle) == 0 && len(sysconfig.DataSaverWhitelist) == 0 &&
+			len(sysconfig.SystemWhitelist) == 0 && len(sysconfig.SystemBlacklist) == 0 {
+			continue
 		}
-	}
 
-	if len(sysconfig.DozeWhitelist) > 0 || len(sysconfig.DozeWhitelistExceptIdle) > 0 || len(sysconfig.DataSaverWhitelist) > 0 ||
-		len(sysconfig.SystemWhitelist) > 0 || len(sysconfig.SystemBlacklist) > 0 {
+		fileInfo := lib.FileInfo{
+			Destination: part + "/etc/sysconfig/" + zip.Name + ".xml",
+			Mode:        "0644",
+			FileName:    "sysconfig" + partitionSuffix(part) + ".xml"}
+		fileId := zip.Name + partitionSuffix(part) + "-sysconfig.xml"
+		fmt.Println("Generating sysconfig file for " + zip.Name + " on " + part)
 
-		fmt.Println("Generating sysconfig file for " + zip.Name)
-		fileDest := filepath.Join(root, "files")
-		err := os.MkdirAll(fileDest, os.ModeDir|0755)
+		err := writeGeneratedXML(z, fileId, &fileInfo,
+			generatedFileVersions(z.Plan, partApps, &fileInfo, zip.Versions[0]), sysconfig)
 		if err != nil {
-			return fmt.Errorf("Error while creating directory at %v:\n  %v", fileDest, err)
+			return err
 		}
-		fileDest = filepath.Join(fileDest, "sysconfig.xml")
-
-		file, err := os.Create(fileDest)
-		if err != nil {
-			return fmt.Errorf("Error while creating file %v:\n  %v", fileDest, err)
-		}
-		defer file.Close()
-
-		_, err = file.Write([]byte(xml.Header))
-		if err != nil {
-			return fmt.Errorf("Error while writing XML header to %v:\n  %v", fileDest, err)
-		}
-
-		enc := xml.NewEncoder(file)
-		enc.Indent("", "    ")
-		err = enc.Encode(sysconfig)
-		if err != nil {
-			return fmt.Errorf("Error while writing sysconfig XML to %v:\n  %v", fileDest, err)
-		}
-
-		// File was created, add to files list for install/addon.d backup
-		zip.RLock()
-		fileId := zip.Name + "-sysconfig.xml"
-		zip.RUnlock()
-		files.Lock()
-		files.SetFile(fileId, &lib.AndroidVersions{})
-		files.Unlock()
-
-		files.LockFile(fileId)
-		files.GetFile(fileId).Version = sysconfigFile
-		files.UnlockFile(fileId)
-
-		zip.Lock()
-		zip.Files = append(zip.Files, fileId)
-		zip.Unlock()
 	}
 	return nil
 }
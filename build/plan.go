@@ -0,0 +1,195 @@
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.com/Shadow53/zip-builder/apk"
+	"gitlab.com/Shadow53/zip-builder/config"
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// A zip is built in two phases. Planning resolves what the zip installs on
+// each of its Android versions and architectures, including the names of the
+// downloaded files and which APK to take from F-Droid repositories, into a
+// plan that belongs to that zip alone. Building only reads the plan, so zips
+// never change the configuration they share. What can only be known once
+// files are downloaded, like the manifests of APKs and the libraries inside
+// them, is kept next to the plan by the goroutine building the zip.
+
+// zipPlan is what a zip installs. It is not changed once made.
+type zipPlan struct {
+	Zip       *lib.ZipInfo
+	Versions  *lib.VersionTable // The Android versions of the configuration
+	Apps      []*planItem
+	Files     []*planItem
+	Downloads []*planDownload
+}
+
+// planItem is an app or file of a zip
+type planItem struct {
+	Name    string
+	App     *lib.AppInfo                       // The configuration of an app, nil for files
+	Version map[string]*lib.AndroidVersionInfo // Only the versions and arches of the zip
+}
+
+// planDownload is a file to download into the zip. Versions that share the
+// configuration of Ver install the same file.
+type planDownload struct {
+	Item *planItem
+	Ver  string
+	Arch string
+	File *lib.FileInfo // The copy in Item.Version[Ver]
+}
+
+// planVersions copies the versions of an app or file that zip installs, so
+// the plan can fill in file names without changing the configuration.
+// Versions that share a configuration keep sharing their copy.
+func planVersions(config map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo) map[string]*lib.AndroidVersionInfo {
+	copies := make(map[*lib.AndroidVersionInfo]*lib.AndroidVersionInfo)
+	versions := make(map[string]*lib.AndroidVersionInfo)
+	for _, ver := range zip.Versions {
+		info := config[ver]
+		if info == nil {
+			continue
+		}
+		if copies[info] == nil {
+			infoCopy := &lib.AndroidVersionInfo{
+				Base:                info.Base,
+				HasArchSpecificInfo: info.HasArchSpecificInfo,
+				Arch:                make(map[string]*lib.FileInfo)}
+			for _, arch := range append([]string{lib.NOARCH}, zip.Arches...) {
+				if file := info.Arch[arch]; file != nil {
+					fileCopy := *file
+					infoCopy.Arch[arch] = &fileCopy
+				}
+			}
+			copies[info] = infoCopy
+		}
+		versions[ver] = copies[info]
+	}
+	return versions
+}
+
+// planDownloads returns the files of item to download, one for each version
+// of the zip that other versions are based on and each arch of the zip if the
+// item has arch specific files
+func planDownloads(item *planItem, zip *lib.ZipInfo) []*planDownload {
+	var downloads []*planDownload
+	for _, ver := range zip.Versions {
+		info := item.Version[ver]
+		if info == nil || info.Base != ver {
+			continue
+		}
+		arches := []string{lib.NOARCH}
+		if info.HasArchSpecificInfo {
+			arches = zip.Arches
+		}
+		for _, arch := range arches {
+			if file := info.Arch[arch]; file != nil {
+				downloads = append(downloads, &planDownload{Item: item, Ver: ver, Arch: arch, File: file})
+			}
+		}
+	}
+	return downloads
+}
+
+// planZip resolves what zip, one of the zips of cfg, installs. cfg is only
+// read.
+func (b *Builder) planZip(ctx context.Context, cfg *config.Config, zip *lib.ZipInfo) (*zipPlan, error) {
+	lib.Debug("PLANNING ZIP: " + zip.Name)
+	apps, files := cfg.Apps, cfg.Files
+	plan := &zipPlan{Zip: zip, Versions: cfg.Versions}
+
+	for _, name := range zip.Apps {
+		app := apps.GetApp(name)
+		if app == nil {
+			return nil, fmt.Errorf("App %v is not defined", name)
+		}
+		item := &planItem{Name: name, App: app, Version: planVersions(app.Android.Version, zip)}
+		plan.Apps = append(plan.Apps, item)
+
+		for _, download := range planDownloads(item, zip) {
+			// Build file name with version/architecture
+			filename := app.PackageName + "-" + download.Ver
+			if item.Version[download.Ver].HasArchSpecificInfo {
+				filename = filename + "-" + download.Arch
+			}
+			download.File.FileName = filename + ".apk"
+			lib.Debug("APP " + name + " FOR " + download.Ver + " " + download.Arch + " WILL BE SAVED AS " + download.File.FileName)
+
+			if app.UrlIsFDroidRepo {
+				err := b.dl.ResolveFDroidApk(ctx, plan.Versions, app, zip, download.File, download.Ver, download.Arch)
+				if err != nil {
+					return nil, err
+				}
+			}
+			plan.Downloads = append(plan.Downloads, download)
+		}
+	}
+
+	for _, name := range zip.Files {
+		file := files.GetFile(name)
+		if file == nil {
+			return nil, fmt.Errorf("File %v is not defined", name)
+		}
+		item := &planItem{Name: name, Version: planVersions(file.Version, zip)}
+		plan.Files = append(plan.Files, item)
+
+		for _, download := range planDownloads(item, zip) {
+			if download.File.Url == "" {
+				lib.Debug("WARNING: URL IS EMPTY FOR " + name)
+				continue
+			}
+			filename := download.File.FileName + "." + download.Ver
+			if item.Version[download.Ver].HasArchSpecificInfo {
+				filename = filename + "." + download.Arch
+			}
+			download.File.FileName = filename
+			lib.Debug("FILE " + name + " FOR " + download.Ver + " " + download.Arch + " WILL BE SAVED AS " + filename)
+			plan.Downloads = append(plan.Downloads, download)
+		}
+	}
+	return plan, nil
+}
+
+// zipBuild is a zip being built from its plan, along with what is learned
+// while building it. Only the goroutine building the zip uses it.
+type zipBuild struct {
+	Plan  *zipPlan
+	Root  string                      // The folder the zip is assembled in
+	Apks  map[*lib.FileInfo]*apk.Info // Manifests of the downloaded APKs
+	Extra []*planItem                 // Extracted libraries and generated files
+}
+
+func newZipBuild(plan *zipPlan, root string) *zipBuild {
+	return &zipBuild{Plan: plan, Root: root, Apks: make(map[*lib.FileInfo]*apk.Info)}
+}
+
+// files returns the files the zip installs: the ones in the plan, then the
+// extracted libraries and generated files
+func (z *zipBuild) files() []*planItem {
+	return append(append([]*planItem{}, z.Plan.Files...), z.Extra...)
+}
+
+// filePermissions returns the permissions an app file requests: those the
+// F-Droid repository lists, or those in the downloaded APK if the app has no
+// permissions configured
+func (z *zipBuild) filePermissions(item *planItem, file *lib.FileInfo) []string {
+	if info := z.Apks[file]; info != nil && len(item.App.Permissions) == 0 {
+		return info.Permissions
+	}
+	return file.Permissions
+}
+
+// resolvedVersion returns the version of the APK a file installs, as chosen
+// from an F-Droid repository or read from the downloaded APK
+func (z *zipBuild) resolvedVersion(file *lib.FileInfo) (string, int) {
+	if file.ResolvedVersion != "" || file.ResolvedVersionCode != 0 {
+		return file.ResolvedVersion, file.ResolvedVersionCode
+	}
+	if info := z.Apks[file]; info != nil {
+		return info.VersionName, info.VersionCode
+	}
+	return "", 0
+}
@@ -0,0 +1,179 @@
+package build
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Starting with Android 8.0, privileged permissions are only granted to
+// priv-apps that are whitelisted in etc/permissions on their partition. Depending on
+// ro.control_privapp_permissions, missing entries either get the permission
+// silently denied or stop the device from booting.
+
+const privappMinVersion = "8.0"
+
+// Permissions with a protection level of signature|privileged in AOSP, used to
+// pick the privileged permissions out of an APK manifest when
+// privileged_permissions is not configured. Permissions missing here can
+// still be listed in the config.
+var privilegedPermissions = []string{
+	"android.permission.ACCESS_CACHE_FILESYSTEM",
+	"android.permission.ACCESS_CHECKIN_PROPERTIES",
+	"android.permission.BACKUP",
+	"android.permission.BIND_APPWIDGET",
+	"android.permission.CALL_PRIVILEGED",
+	"android.permission.CAPTURE_AUDIO_HOTWORD",
+	"android.permission.CAPTURE_AUDIO_OUTPUT",
+	"android.permission.CAPTURE_SECURE_VIDEO_OUTPUT",
+	"android.permission.CAPTURE_VIDEO_OUTPUT",
+	"android.permission.CHANGE_APP_IDLE_STATE",
+	"android.permission.CHANGE_COMPONENT_ENABLED_STATE",
+	"android.permission.CHANGE_CONFIGURATION",
+	"android.permission.CHANGE_DEVICE_IDLE_TEMP_WHITELIST",
+	"android.permission.CONNECTIVITY_INTERNAL",
+	"android.permission.DELETE_PACKAGES",
+	"android.permission.DUMP",
+	"android.permission.FORCE_STOP_PACKAGES",
+	"android.permission.GET_ACCOUNTS_PRIVILEGED",
+	"android.permission.GET_APP_OPS_STATS",
+	"android.permission.INSTALL_LOCATION_PROVIDER",
+	"android.permission.INSTALL_PACKAGES",
+	"android.permission.INTERACT_ACROSS_USERS",
+	"android.permission.INVOKE_CARRIER_SETUP",
+	"android.permission.LOCAL_MAC_ADDRESS",
+	"android.permission.LOCATION_HARDWARE",
+	"android.permission.MANAGE_DOCUMENTS",
+	"android.permission.MANAGE_USB",
+	"android.permission.MANAGE_USERS",
+	"android.permission.MASTER_CLEAR",
+	"android.permission.MEDIA_CONTENT_CONTROL",
+	"android.permission.MODIFY_AUDIO_ROUTING",
+	"android.permission.MODIFY_PHONE_STATE",
+	"android.permission.MOUNT_FORMAT_FILESYSTEMS",
+	"android.permission.MOUNT_UNMOUNT_FILESYSTEMS",
+	"android.permission.PACKAGE_USAGE_STATS",
+	"android.permission.PACKAGE_VERIFICATION_AGENT",
+	"android.permission.PERFORM_CDMA_PROVISIONING",
+	"android.permission.READ_LOGS",
+	"android.permission.READ_NETWORK_USAGE_HISTORY",
+	"android.permission.READ_PRIVILEGED_PHONE_STATE",
+	"android.permission.READ_SEARCH_INDEXABLES",
+	"android.permission.READ_WIFI_CREDENTIAL",
+	"android.permission.REAL_GET_TASKS",
+	"android.permission.REBOOT",
+	"android.permission.RECEIVE_DATA_ACTIVITY_CHANGE",
+	"android.permission.RECOVERY",
+	"android.permission.SEND_RESPOND_VIA_MESSAGE",
+	"android.permission.SEND_SMS_NO_CONFIRMATION",
+	"android.permission.SET_TIME",
+	"android.permission.SET_TIME_ZONE",
+	"android.permission.STATUS_BAR",
+	"android.permission.SUBSTITUTE_NOTIFICATION_APP_NAME",
+	"android.permission.UPDATE_APP_OPS_STATS",
+	"android.permission.UPDATE_DEVICE_STATS",
+	"android.permission.USE_RESERVED_DISK",
+	"android.permission.WRITE_APN_SETTINGS",
+	"android.permission.WRITE_MEDIA_STORAGE",
+	"android.permission.WRITE_SECURE_SETTINGS"}
+
+type PrivappPermission struct {
+	XMLName xml.Name `xml:"permission"`
+	Name    string   `xml:"name,attr"`
+}
+
+type PrivappApp struct {
+	XMLName     xml.Name            `xml:"privapp-permissions"`
+	Package     string              `xml:"package,attr"`
+	Permissions []PrivappPermission `xml:"permission"`
+}
+
+type PrivappPermissions struct {
+	XMLName xml.Name     `xml:"permissions"`
+	Apps    []PrivappApp `xml:"privapp-permissions"`
+}
+
+// isPrivApp reports whether any version of the app in the zip installs to
+// the priv-app folder of a partition
+func isPrivApp(app *planItem, zip *lib.ZipInfo) bool {
+	for _, ver := range zip.Versions {
+		if app.Version[ver] == nil {
+			continue
+		}
+		for _, file := range app.Version[ver].Arch {
+			if file == nil {
+				continue
+			}
+			part := lib.PartitionOf(file.Destination)
+			if lib.IsSystemPartition(part) && strings.HasPrefix(file.Destination, part+"/priv-app/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appPrivilegedPermissions returns the configured privileged permissions of
+// an app, or the privileged ones among all of its permissions
+func appPrivilegedPermissions(z *zipBuild, app *planItem) []string {
+	var permissions []string
+	if app.App.PrivilegedPermissions != nil {
+		for _, perm := range app.App.PrivilegedPermissions {
+			permissions = append(permissions, normalizePermission(perm))
+		}
+	} else {
+		for _, perm := range appPermissions(z, app) {
+			if lib.StringSliceContains(privilegedPermissions, perm) {
+				permissions = append(permissions, perm)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+func makePrivappPermsFile(z *zipBuild) error {
+	zip := z.Plan.Zip
+	byPartition := appsByPartition(z.Plan)
+	for _, part := range lib.Partitions {
+		var privapp PrivappPermissions
+		var privApps []*planItem
+		for _, app := range byPartition[part] {
+			if isPrivApp(app, zip) {
+				entry := PrivappApp{Package: app.App.PackageName}
+				for _, perm := range appPrivilegedPermissions(z, app) {
+					entry.Permissions = append(entry.Permissions, PrivappPermission{Name: perm})
+				}
+				if len(entry.Permissions) > 0 {
+					privapp.Apps = append(privapp.Apps, entry)
+					privApps = append(privApps, app)
+				}
+			}
+		}
+		if len(privapp.Apps) == 0 {
+			continue
+		}
+
+		fileInfo := lib.FileInfo{
+			Destination: part + "/etc/permissions/privapp-permissions-" + zip.Name + ".xml",
+			Mode:        "0644",
+			FileName:    "privapp-permissions" + partitionSuffix(part) + ".xml"}
+		fileId := zip.Name + partitionSuffix(part) + "-privapp-permissions.xml"
+
+		// Older versions do not read the file, so it is only installed on 8.0+
+		versions := generatedFileVersions(z.Plan, privApps, &fileInfo, privappMinVersion)
+		if len(versions) == 0 {
+			continue
+		}
+
+		fmt.Println("Generating privapp-permissions file for " + zip.Name + " on " + part)
+		err := writeGeneratedXML(z, fileId, &fileInfo, versions, privapp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
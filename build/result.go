@@ -0,0 +1,77 @@
+package build
+
+import (
+	"context"
+	"errors"
+)
+
+// Status is how building or fetching a zip ended
+type Status int
+
+const (
+	StatusBuilt   Status = iota
+	StatusFetched        // Everything the zip needs was downloaded, see FetchZip
+	StatusSkipped        // The zip was up to date
+	StatusFailed
+	StatusCancelled // Stopped before finishing, without errors of its own
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusBuilt:
+		return "built"
+	case StatusFetched:
+		return "fetched"
+	case StatusSkipped:
+		return "up to date"
+	case StatusFailed:
+		return "failed"
+	case StatusCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// Result is the outcome of building or fetching one zip
+type Result struct {
+	Zip    string
+	Status Status
+	Errors []error // Why the zip failed, empty otherwise
+}
+
+// collectResult runs fn, gathering the errors it sends on its channel into
+// the result. Any error fails the zip, whatever status fn returns. Once ctx
+// is cancelled, a zip whose only errors come from cancelling is reported as
+// cancelled, while one that also failed on its own keeps its errors.
+func collectResult(ctx context.Context, name string, fn func(ch chan error) Status) Result {
+	ch := make(chan error)
+	done := make(chan bool)
+	result := Result{Zip: name}
+	go func() {
+		for err := range ch {
+			result.Errors = append(result.Errors, err)
+		}
+		done <- true
+	}()
+
+	result.Status = fn(ch)
+	close(ch)
+	<-done
+	if (result.Status == StatusFailed || result.Status == StatusCancelled) && ctx.Err() != nil && onlyCancelled(result.Errors) {
+		result.Status = StatusCancelled
+		result.Errors = nil
+	} else if len(result.Errors) > 0 {
+		result.Status = StatusFailed
+	}
+	return result
+}
+
+// onlyCancelled reports whether every error was caused by cancelling
+func onlyCancelled(errs []error) bool {
+	for _, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			return false
+		}
+	}
+	return true
+}
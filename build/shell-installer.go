@@ -0,0 +1,144 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// shellDialect generates a POSIX sh update-binary, for recoveries that run
+// update-binary directly instead of relying on it to interpret edify. Those
+// are Android 10+ recoveries, which provide /system/bin/sh but not /sbin/sh.
+type shellDialect struct{}
+
+// quote makes a string safe to use as a single shell word
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+func (shellDialect) header(partitions []string, buffer *bytes.Buffer) {
+	buffer.WriteString(`#!/system/bin/sh
+#
+# This installer was automatically generated by zip-builder
+#
+
+OUTFD=$2
+ZIPFILE=$3
+
+# Messages are shown by writing recovery commands to the file descriptor
+# passed as the second argument
+ui_print() {
+  printf 'ui_print %s\nui_print\n' "$1" >> /proc/self/fd/$OUTFD
+}
+
+abort() {
+  ui_print "$1"
+  exit 1
+}
+
+extract() {
+  unzip -p "$ZIPFILE" "$1" > "$2"
+}
+
+ui_print "--------------------------------------"
+extract META-INF/com/google/android/mount-partitions.sh ` + mountScript + ` || abort "E: Could not extract the mount script"
+chmod 0755 ` + mountScript + `
+`)
+	for _, part := range partitions {
+		buffer.WriteString("ui_print \"Mounting " + part + "\"\n")
+		buffer.WriteString("sh " + mountScript + " mount " + part + " || abort " + quote(mountError(part)) + "\n")
+	}
+	buffer.WriteString(`
+prop() {
+  sed -n "s/^$1=//p" /system/build.prop | head -n 1
+}
+SDK=$(prop ro.build.version.sdk)
+ABILIST="$(getprop ro.product.cpu.abilist) $(getprop ro.product.cpu.abi)"
+ui_print "Detected Android version: $(prop ro.build.version.release) (SDK $SDK)"
+ui_print "Detected arch: $ABILIST"
+`)
+}
+
+func (shellDialect) footer(partitions []string, buffer *bytes.Buffer) {
+	for i := len(partitions) - 1; i >= 0; i-- {
+		buffer.WriteString("ui_print \"Unmounting " + partitions[i] + "\"\n")
+		buffer.WriteString("sh " + mountScript + " unmount " + partitions[i] + "\n")
+	}
+}
+
+func (shellDialect) print(msg string, buffer *bytes.Buffer) {
+	buffer.WriteString("ui_print " + quote(msg) + "\n")
+}
+
+func (shellDialect) beginIf(cond string, buffer *bytes.Buffer) {
+	buffer.WriteString("if " + cond + "; then\n")
+}
+
+func (shellDialect) endIf(buffer *bytes.Buffer) {
+	buffer.WriteString("fi\n")
+}
+
+func (shellDialect) versionTest(min, max int) string {
+	return fmt.Sprintf("[ \"$SDK\" -ge %v ] && [ \"$SDK\" -le %v ]", min, max)
+}
+
+func (shellDialect) abiTest(abi string) string {
+	return "echo \"$ABILIST\" | grep -q " + quote(abi)
+}
+
+func (shellDialect) dirTest(path string) string {
+	return "[ -d " + quote(path) + " ]"
+}
+
+func (shellDialect) tryMount(part string, buffer *bytes.Buffer) {
+	buffer.WriteString("sh " + mountScript + " mount " + part + "\n")
+}
+
+func (shellDialect) installFile(file *lib.FileInfo, buffer *bytes.Buffer) {
+	dest := quote(file.Destination)
+	destParent := quote(file.Destination[0:strings.LastIndex(file.Destination, "/")])
+	buffer.WriteString("mkdir -p " + destParent + " || abort " + quote("E: Could not create "+file.Destination[0:strings.LastIndex(file.Destination, "/")]) + "\n")
+	buffer.WriteString("chown 0:0 " + destParent + " && chmod 0755 " + destParent + "\n")
+	buffer.WriteString("ui_print " + quote("Extracting "+file.Destination) + "\n")
+	buffer.WriteString("extract " + quote("files/"+file.FileName) + " " + dest + " || abort " + quote("E: Could not extract "+file.Destination) + "\n")
+	buffer.WriteString("chown 0:0 " + dest + " && chmod " + file.Mode + " " + dest + " || abort " + quote("E: Could not set permissions of "+file.Destination) + "\n")
+}
+
+func (shellDialect) deleteFile(file string, buffer *bytes.Buffer) {
+	path := quote(file)
+	buffer.WriteString("if [ -d " + path + " ]; then\n")
+	buffer.WriteString("  ui_print " + quote("Recursively deleting existing folder "+file) + "\n")
+	buffer.WriteString("  rm -rf " + path + "\n")
+	buffer.WriteString("elif [ -f " + path + " ]; then\n")
+	buffer.WriteString("  ui_print " + quote("Deleting existing file "+file) + "\n")
+	buffer.WriteString("  rm -f " + path + "\n")
+	buffer.WriteString("fi\n")
+}
+
+// write saves the script as update-binary. Recoveries still expect an
+// updater-script to exist, so a placeholder is written next to it.
+func (shellDialect) write(root string, script []byte) error {
+	scriptDest := filepath.Join(root, "/META-INF/com/google/android")
+	err := os.MkdirAll(scriptDest, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", scriptDest, err)
+	}
+
+	binaryDest := filepath.Join(scriptDest, "update-binary")
+	err = ioutil.WriteFile(binaryDest, script, 0755)
+	if err != nil {
+		return fmt.Errorf("Error while writing update-binary to %v:\n  %v", binaryDest, err)
+	}
+
+	scriptDest = filepath.Join(scriptDest, "updater-script")
+	err = ioutil.WriteFile(scriptDest, []byte("# This zip is installed by the shell script in update-binary\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error while writing updater-script to %v:\n  %v", scriptDest, err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package build
+
+import (
+	"fmt"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+	"gitlab.com/Shadow53/zip-builder/lib"
+	"gitlab.com/Shadow53/zip-builder/sign"
+)
+
+// signZip signs the built zip at path if the zip has a key configured, and
+// returns the SHA-256 of the certificate it was signed with
+func signZip(path string, zip *lib.ZipInfo) (string, error) {
+	keyPath := zip.SigningKey
+	certPath := zip.SigningCert
+	if keyPath == "" {
+		return "", nil
+	}
+
+	key, err := sign.LoadPrivateKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+	cert, err := sign.LoadCertificate(certPath)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint := jar.Fingerprint(cert)
+	fmt.Println("Signing " + path + " with certificate " + fingerprint)
+	return fingerprint, sign.SignZip(path, key, cert)
+}
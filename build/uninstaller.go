@@ -0,0 +1,142 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Uninstaller zips remove everything the matching zip installs. They are made
+// after the zip is built, when the apps and files of the zip also include the
+// extracted libraries, generated permissions files and addon.d script.
+
+// appFolder returns the folder an app is installed into, if the app has one
+// of its own, like /system/priv-app/<Name>/<Name>.apk
+func appFolder(dest string) string {
+	folder := filepath.Dir(dest)
+	switch filepath.Base(filepath.Dir(folder)) {
+	case "app", "priv-app":
+		return folder
+	}
+	return ""
+}
+
+// addDestinations adds every path an item is installed to on any version of
+// the zip to dests. Apps are removed along with their folder, which also holds
+// their extracted libraries.
+func addDestinations(item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo, isApp bool, dests map[string]bool) {
+	for _, ver := range zip.Versions {
+		if item[ver] == nil {
+			continue
+		}
+		for _, file := range item[ver].Arch {
+			if file == nil || file.Destination == "" {
+				continue
+			}
+			if folder := appFolder(file.Destination); isApp && folder != "" {
+				dests[folder] = true
+			} else {
+				dests[file.Destination] = true
+			}
+		}
+	}
+}
+
+// uninstallPaths returns the sorted paths to remove, leaving out any inside a
+// folder that is already removed
+func uninstallPaths(z *zipBuild) []string {
+	dests := make(map[string]bool)
+	for _, app := range z.Plan.Apps {
+		addDestinations(app.Version, z.Plan.Zip, true, dests)
+	}
+	for _, file := range z.files() {
+		addDestinations(file.Version, z.Plan.Zip, false, dests)
+	}
+
+	var toRemove []string
+	for _, path := range lib.SortedKeys(dests) {
+		if n := len(toRemove); n > 0 && strings.HasPrefix(path, toRemove[n-1]+"/") {
+			continue
+		}
+		toRemove = append(toRemove, path)
+	}
+	return toRemove
+}
+
+// makeUninstallZip builds <name>-uninstall.zip next to the zip, using the
+// same installer as the zip. dir is the temporary folder of the build.
+func (b *Builder) makeUninstallZip(dir string, z *zipBuild, fingerprint string) error {
+	zip := z.Plan.Zip
+	name := zip.Name + "-uninstall"
+
+	fmt.Println("Generating uninstaller " + name)
+	root := filepath.Join(dir, "build", name)
+	err := os.MkdirAll(root, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", root, err)
+	}
+	defer os.RemoveAll(root)
+
+	paths := uninstallPaths(z)
+	parts := map[string]bool{"/system": true}
+	for _, path := range paths {
+		parts[lib.PartitionOf(path)] = true
+	}
+	var partitions []string
+	for _, part := range lib.Partitions {
+		if parts[part] {
+			partitions = append(partitions, part)
+		}
+	}
+
+	d := dialectFor(zip)
+	var script bytes.Buffer
+	d.header(partitions, &script)
+	for _, path := range paths {
+		lib.Debug("UNINSTALLING: " + path)
+		d.deleteFile(path, &script)
+	}
+	d.footer(partitions, &script)
+	d.print("Done!", &script)
+	d.print("--------------------------------------", &script)
+
+	err = d.write(root, script.Bytes())
+	if err != nil {
+		return err
+	}
+	if zip.Installer == lib.InstallerEdify {
+		err = writeUpdateBinary(root, zip)
+		if err != nil {
+			return fmt.Errorf("Error while adding update-binary:\n  %v", err)
+		}
+	}
+	err = writeMountScript(root)
+	if err != nil {
+		return fmt.Errorf("Error while adding mount script:\n  %v", err)
+	}
+
+	zipLocation, err := b.zipFolder(root, name)
+	if err != nil {
+		return fmt.Errorf("Error while zipping contents of %v:\n  %v", root, err)
+	}
+	signer, err := signZip(zipLocation, zip)
+	if err != nil {
+		return fmt.Errorf("Error while signing zip at %v:\n  %v", zipLocation, err)
+	}
+	err = lib.GenerateMD5File(zipLocation)
+	if err != nil {
+		return fmt.Errorf("Error while generating md5 for zip at %v:\n  %v", zipLocation, err)
+	}
+
+	manifest, err := newManifest(zipLocation, signer, fingerprint, zip)
+	if err != nil {
+		return err
+	}
+	manifest.Name = name
+	manifest.Removes = paths
+	return writeManifest(zipLocation, manifest)
+}
@@ -2,145 +2,172 @@ package build
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
-func processUnzipFile(file *zip.File, app *lib.AppInfo, root, ver, arch, a string, files *lib.Files, zipinfo *lib.ZipInfo, wg *sync.WaitGroup, ch chan string) {
-	defer wg.Done()
-	if !app.Android.Version[ver].HasArchSpecificInfo || arch == a {
-		// Only create the parent folder if there is a file to extract
-		fileName := file.Name[strings.LastIndex(file.Name, "lib/")+4:]
-		libArch := fileName[:strings.Index(fileName, "/")]
-		// Simplifying the arch name for arm was reported to fix crashing issues
-		if strings.HasPrefix(libArch, "armeabi") {
-			libArch = "arm"
-		} else if strings.HasPrefix(libArch, "arm64") {
-			libArch = "arm64"
-		}
-		fileName = fileName[strings.Index(fileName, "/")+1:] // Remove leading "/"
-		destFolder := filepath.Join(root, "files", app.PackageName+"-lib", ver)
-		err := os.MkdirAll(destFolder, os.ModeDir|0755)
-		if err != nil {
-			ch <- fmt.Sprintf("Error while making a directory at %v:\n  %v", destFolder, err)
-			return
+// libTargets returns the arches of the zip a library for libArch is installed
+// on when it comes from the APK of download
+func libTargets(libArch string, download *planDownload, zipinfo *lib.ZipInfo) []string {
+	var targets []string
+	for _, a := range zipinfo.Arches {
+		if download.Item.Version[download.Ver].HasArchSpecificInfo && download.Arch != a {
+			continue
 		}
 		// Add exception for 32-bit arm libs on 64-bit arm devices - fix Firefox crash
 		if a == libArch || (a == "arm64" && libArch == "arm") {
-			path := filepath.Join(destFolder, libArch, fileName)
-			err = os.MkdirAll(path[:strings.LastIndex(path, "/")], os.ModeDir|0755)
-			if err != nil {
-				ch <- fmt.Sprintf("Error while making a directory at %v:\n  %v", path[:strings.LastIndex(path, "/")], err)
-				return
-			}
-
-			fileReader, err := file.Open()
-			if err != nil {
-				ch <- fmt.Sprintf("Error while opening %v from apk for reading:\n  %v", file.Name, err)
-				return
-			}
-			defer fileReader.Close()
-
-			targetFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-			if err != nil {
-				ch <- fmt.Sprintf("Error while opening %v for writing:\n  %v", path, err)
-				return
-			}
-			defer targetFile.Close()
-
-			lib.Verbose("Extracting library from " + app.PackageName + ": " + file.Name)
-			_, err = io.Copy(targetFile, fileReader)
-			if err != nil {
-				ch <- fmt.Sprintf("Error while copying from %v to %v:\n  %v", file.Name, path, err)
-				return
-			}
-
-			lib.Debug("Creating file entry for " + file.Name)
-			// Will only be reached by actual files
-			zipinfo.RLock()
-			fileId := zipinfo.Name + "-" + app.PackageName + "-" + file.Name
-			zipinfo.RUnlock()
-			// If file extracted correctly without problems, add to list
-			files.Lock()
-			files.File[fileId] = &lib.AndroidVersions{}
-			files.Unlock()
-
-			files.LockFile(fileId)
-			if files.GetFile(fileId).Version == nil {
-				files.GetFile(fileId).Version = make(map[string]*lib.AndroidVersionInfo)
-			}
-			files.UnlockFile(fileId)
-
-			for i := sort.SearchStrings(zipinfo.Versions, ver); i < len(zipinfo.Versions) && app.Android.Version[zipinfo.Versions[i]].Base == ver; i++ {
-				v := zipinfo.Versions[i]
-				lib.Debug("Adding lib to Android version " + v)
-
-				files.LockFile(fileId)
-				if !files.FileVersionExists(fileId, v) {
-					files.SetFileVersion(fileId, v, &lib.AndroidVersionInfo{
-						Base:                ver,
-						Arch:                make(map[string]*lib.FileInfo),
-						HasArchSpecificInfo: true})
-				}
-				files.UnlockFile(fileId)
-
-				dest := app.Android.Version[ver].Arch[arch].Destination
-				dest = dest[0:strings.LastIndex(dest, "/")+1] + "lib/" + libArch + "/" + fileName
-
-				files.LockFileVersion(fileId, v)
-				files.SetFileVersionArch(fileId, v, a, &lib.FileInfo{
-					Destination: dest,
-					Mode:        "0644",
-					FileName:    app.PackageName + "-lib/" + ver + "/" + libArch + "/" + fileName})
-				files.UnlockFileVersion(fileId, v)
-			}
-
-			zipinfo.Lock()
-			zipinfo.Files = append(zipinfo.Files, fileId)
-			zipinfo.Unlock()
+			targets = append(targets, a)
 		}
 	}
+	return targets
 }
 
-// Only extracts libraries if being installed under /system
-// To be fair, that's almost always where apps get installed...
-func unzipSystemLibs(root string, zipinfo *lib.ZipInfo, app *lib.AppInfo, ver, arch string, files *lib.Files) error {
-	if strings.HasPrefix(app.Android.Version[ver].Arch[arch].Destination, "/system/") {
-		// Hold all library files for this app in {ZIPROOT}/files/app-lib/
-		fmt.Println("Extracting library files from " + app.Android.Version[ver].Arch[arch].FileName)
-		zipLoc := filepath.Join(root, "files", app.Android.Version[ver].Arch[arch].FileName)
-		reader, err := zip.OpenReader(zipLoc)
-		if err != nil {
-			return fmt.Errorf("Error while opening the apk at %v:\n  %v", zipLoc, err)
+// extractLib copies a file out of an APK to path
+func (b *Builder) extractLib(ctx context.Context, file *zip.File, path string) error {
+	err := b.extractSlots.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("Error while waiting to extract %v:\n  %w", file.Name, err)
+	}
+	defer b.extractSlots.Release()
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while making a directory at %v:\n  %v", filepath.Dir(path), err)
+	}
+
+	fileReader, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("Error while opening %v from apk for reading:\n  %v", file.Name, err)
+	}
+	defer fileReader.Close()
+
+	targetFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+	if err != nil {
+		return fmt.Errorf("Error while opening %v for writing:\n  %v", path, err)
+	}
+	defer targetFile.Close()
+
+	_, err = io.Copy(targetFile, fileReader)
+	if err != nil {
+		return fmt.Errorf("Error while copying from %v to %v:\n  %v", file.Name, path, err)
+	}
+	return nil
+}
+
+// processUnzipFile extracts a library from the APK of download and returns
+// the file of the zip that installs it, or nil if no arch of the zip uses it
+func (b *Builder) processUnzipFile(ctx context.Context, file *zip.File, root, libFolder string, plan *zipPlan, download *planDownload) (*planItem, error) {
+	fileName := file.Name[strings.LastIndex(file.Name, "lib/")+4:]
+	if strings.Index(fileName, "/") < 0 || strings.HasSuffix(fileName, "/") {
+		return nil, nil
+	}
+	libArch := fileName[:strings.Index(fileName, "/")]
+	// Simplifying the arch name for arm was reported to fix crashing issues
+	if strings.HasPrefix(libArch, "armeabi") {
+		libArch = "arm"
+	} else if strings.HasPrefix(libArch, "arm64") {
+		libArch = "arm64"
+	}
+	fileName = fileName[strings.Index(fileName, "/")+1:] // Remove leading "/"
+
+	targets := libTargets(libArch, download, plan.Zip)
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	libFile := &lib.FileInfo{
+		Mode:     "0644",
+		FileName: libFolder + "/" + libArch + "/" + fileName}
+	lib.Verbose("Extracting library from " + download.Item.App.PackageName + ": " + file.Name)
+	err := b.extractLib(ctx, file, filepath.Join(root, "files", libFile.FileName))
+	if err != nil {
+		return nil, err
+	}
+
+	lib.Debug("Creating file entry for " + file.Name)
+	dest := download.File.Destination
+	libFile.Destination = dest[0:strings.LastIndex(dest, "/")+1] + "lib/" + libArch + "/" + fileName
+
+	info := &lib.AndroidVersionInfo{
+		Base:                download.Ver,
+		Arch:                make(map[string]*lib.FileInfo),
+		HasArchSpecificInfo: true}
+	for _, a := range targets {
+		info.Arch[a] = libFile
+	}
+	versions := make(map[string]*lib.AndroidVersionInfo)
+	for _, v := range plan.Zip.Versions {
+		if appVer := download.Item.Version[v]; appVer != nil && appVer.Base == download.Ver {
+			lib.Debug("Adding lib to Android version " + v)
+			versions[v] = info
+		}
+	}
+	return &planItem{Name: plan.Zip.Name + "-" + libFile.FileName, Version: versions}, nil
+}
+
+// Only extracts libraries if being installed to a system partition, apps
+// installed to /data extract their own. Each library is returned as a file
+// of the zip.
+func (b *Builder) unzipSystemLibs(ctx context.Context, root string, plan *zipPlan, download *planDownload) ([]*planItem, error) {
+	if !lib.IsSystemPartition(lib.PartitionOf(download.File.Destination)) {
+		return nil, nil
+	}
+
+	// Hold all library files for this app in {ZIPROOT}/files/app-lib/
+	fmt.Println("Extracting library files from " + download.File.FileName)
+	zipLoc := filepath.Join(root, "files", download.File.FileName)
+	reader, err := zip.OpenReader(zipLoc)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening the apk at %v:\n  %v", zipLoc, err)
+	}
+	defer reader.Close()
+
+	// APKs downloaded for each arch may contain the same libraries
+	libFolder := download.Item.App.PackageName + "-lib/" + download.Ver
+	if download.Arch != lib.NOARCH {
+		libFolder = libFolder + "-" + download.Arch
+	}
+
+	// Extract only files whose paths begin with "lib/"
+	var wg sync.WaitGroup
+	items := make([]*planItem, len(reader.File))
+	errs := make([]error, len(reader.File))
+	for i, file := range reader.File {
+		if !strings.HasPrefix(file.Name, "lib/") {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
 		}
+		wg.Add(1)
+		go func(i int, file *zip.File) {
+			defer wg.Done()
+			items[i], errs[i] = b.processUnzipFile(ctx, file, root, libFolder, plan, download)
+		}(i, file)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
-		// Extract only files whose paths begin with "lib/"
-		for _, file := range reader.File {
-			if strings.HasPrefix(file.Name, "lib/") {
-				var wg sync.WaitGroup
-				ch := make(chan string)
-				wg.Add(len(zipinfo.Arches))
-				for _, a := range zipinfo.Arches {
-					go processUnzipFile(file, app, root, ver, arch, a, files, zipinfo, &wg, ch)
-				}
-				wg.Wait()
-				close(ch)
-				errs := ""
-				for err := range ch {
-					errs = errs + err + "\n  "
-				}
-				if errs != "" {
-					return fmt.Errorf(errs)
-				}
-			}
+	var libs []*planItem
+	var msgs []string
+	for i := range items {
+		if errs[i] != nil {
+			msgs = append(msgs, errs[i].Error())
+		} else if items[i] != nil {
+			libs = append(libs, items[i])
 		}
 	}
-	return nil
+	if len(msgs) > 0 {
+		return nil, fmt.Errorf("%v", strings.Join(msgs, "\n  "))
+	}
+	return libs, nil
 }
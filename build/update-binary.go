@@ -0,0 +1,60 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder"
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// writeUpdateBinary places the bundled update-binary, or the one configured
+// for the zip, into META-INF after verifying its checksum
+func writeUpdateBinary(root string, zip *lib.ZipInfo) error {
+	custom := zip.UpdateBinary
+	customSum := zip.UpdateBinarySHA256
+
+	var data []byte
+	if custom == "" {
+		err := zipbuilder.VerifyUpdateBinary()
+		if err != nil {
+			return err
+		}
+		data = zipbuilder.UpdateBinary
+	} else {
+		fmt.Println("Using custom update-binary " + custom)
+		if customSum == "" {
+			fmt.Println("WARNING: No update_binary_sha256 configured for " + zip.Name + ", " + custom + " will not be verified")
+		} else {
+			sum, err := lib.GetHash(custom, "sha256")
+			if err != nil {
+				return fmt.Errorf("Error while calculating sha256sum of %v:\n  %v", custom, err)
+			}
+			if !strings.EqualFold(sum, customSum) {
+				return fmt.Errorf("Unexpected sha256sum for %v. Expected %v but got %v", custom, customSum, sum)
+			}
+		}
+
+		var err error
+		data, err = ioutil.ReadFile(custom)
+		if err != nil {
+			return fmt.Errorf("Error while reading %v:\n  %v", custom, err)
+		}
+	}
+
+	dest := filepath.Join(root, "META-INF", "com", "google", "android")
+	err := os.MkdirAll(dest, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", dest, err)
+	}
+	dest = filepath.Join(dest, "update-binary")
+
+	err = ioutil.WriteFile(dest, data, 0755)
+	if err != nil {
+		return fmt.Errorf("Error while writing update-binary to %v:\n  %v", dest, err)
+	}
+	return nil
+}
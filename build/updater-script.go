@@ -11,206 +11,146 @@ import (
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
-// TODO: Add support for arch-specific and Android version-specific files
-func makeFileInstallScriptlet(file *lib.FileInfo, buffer *bytes.Buffer) {
+// The API level of the installed system, not of the recovery
+const systemSdk = "file_getprop(\"/system/build.prop\", \"ro.build.version.sdk\")"
+
+// recoveryShell links to the first shell found in shellCandidates. Older
+// recoveries keep their tools in /sbin, Android 10+ recoveries in /system/bin.
+const recoveryShell = "/tmp/zip-builder-sh"
+
+var shellCandidates = []string{"/sbin/sh", "/system/bin/sh"}
+
+var edifyEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// edifyString quotes s as an edify string literal
+func edifyString(s string) string {
+	return "\"" + edifyEscaper.Replace(s) + "\""
+}
+
+// shellCommand returns an edify expression running command with the
+// recovery's shell, which sees args as $1 and on
+func shellCommand(command string, args ...string) string {
+	quoted := []string{edifyString(recoveryShell), edifyString("-c"), edifyString(command), edifyString("sh")}
+	for _, arg := range args {
+		quoted = append(quoted, edifyString(arg))
+	}
+	return "run_program(" + strings.Join(quoted, ", ") + ")"
+}
+
+// mountCommand returns an edify expression running the mount helper
+func mountCommand(action, partition string) string {
+	return "run_program(" + strings.Join([]string{edifyString(recoveryShell), edifyString(mountScript),
+		edifyString(action), edifyString(partition)}, ", ") + ")"
+}
+
+// edifyDialect generates an updater-script, run by the bundled update-binary
+type edifyDialect struct{}
+
+func (edifyDialect) header(partitions []string, buffer *bytes.Buffer) {
+	buffer.WriteString("ui_print(\"--------------------------------------\");\n")
+	// Find the recovery's shell once, before anything that needs it
+	indent := ""
+	for _, sh := range shellCandidates {
+		link := "run_program(" + strings.Join([]string{edifyString(sh), edifyString("-c"),
+			edifyString("ln -sf " + sh + " " + recoveryShell)}, ", ") + ")"
+		buffer.WriteString(indent + "if " + link + " != 0 then\n")
+		indent += "    "
+	}
+	buffer.WriteString(indent + "abort(\"E: Could not find a shell in " + strings.Join(shellCandidates, " or ") + "\");\n")
+	for range shellCandidates {
+		indent = indent[4:]
+		buffer.WriteString(indent + "endif;\n")
+	}
+	buffer.WriteString("package_extract_file(\"META-INF/com/google/android/mount-partitions.sh\", \"" + mountScript + "\");\n")
+	buffer.WriteString("set_metadata(\"" + mountScript + "\", \"uid\", 0, \"gid\", 0, \"mode\", 0755);\n")
+	for _, part := range partitions {
+		buffer.WriteString("ui_print(\"Mounting " + part + "\");\n")
+		buffer.WriteString("if " + mountCommand("mount", part) + " != 0 then\n")
+		buffer.WriteString("    abort(\"" + mountError(part) + "\");\n")
+		buffer.WriteString("endif;\n")
+	}
+	buffer.WriteString(`ui_print("Detected Android version: " + file_getprop("/system/build.prop", "ro.build.version.release") + " (SDK " + ` + systemSdk + ` + ")");
+ui_print("Detected arch: " + getprop("ro.product.cpu.abilist") + " " + getprop("ro.product.cpu.abi"));
+`)
+}
+
+func (edifyDialect) footer(partitions []string, buffer *bytes.Buffer) {
+	for i := len(partitions) - 1; i >= 0; i-- {
+		buffer.WriteString("ui_print(\"Unmounting " + partitions[i] + "\");\n")
+		buffer.WriteString(mountCommand("unmount", partitions[i]) + ";\n")
+	}
+}
+
+func (edifyDialect) print(msg string, buffer *bytes.Buffer) {
+	buffer.WriteString("ui_print(\"" + msg + "\");\n")
+}
+
+func (edifyDialect) beginIf(cond string, buffer *bytes.Buffer) {
+	buffer.WriteString("if " + cond + " then\n")
+}
+
+func (edifyDialect) endIf(buffer *bytes.Buffer) {
+	buffer.WriteString("endif;\n")
+}
+
+// ro.build.version.release is not used because it is "7.1.2" on some devices
+// and just "10" on newer ones
+func (edifyDialect) versionTest(min, max int) string {
+	return fmt.Sprintf("greater_than_int(%v, \"%v\") && less_than_int(%v, \"%v\")", systemSdk, min-1, systemSdk, max+1)
+}
+
+func (edifyDialect) abiTest(abi string) string {
+	return "is_substring(\"" + abi + "\", getprop(\"ro.product.cpu.abilist\") + getprop(\"ro.product.cpu.abi\"))"
+}
+
+func (edifyDialect) dirTest(path string) string {
+	return shellCommand(`test -d "$1"`, path) + " == 0"
+}
+
+func (edifyDialect) tryMount(part string, buffer *bytes.Buffer) {
+	buffer.WriteString(mountCommand("mount", part) + ";\n")
+}
+
+func (edifyDialect) installFile(file *lib.FileInfo, buffer *bytes.Buffer) {
 	// Create the parent directories of the file and set their metadata
-	file.Mux.RLock()
 	destParent := file.Destination[0:strings.LastIndex(file.Destination, "/")]
-	file.Mux.RUnlock()
-	buffer.WriteString("assert(run_program(\"/sbin/mkdir\", \"-p\", \"")
-	buffer.WriteString(destParent)
-	buffer.WriteString("\") == 0);\n")
+	buffer.WriteString("assert(" + shellCommand(`mkdir -p "$1"`, destParent) + " == 0);\n")
 	buffer.WriteString("assert(set_metadata_recursive(\"")
 	buffer.WriteString(destParent)
 	buffer.WriteString("\", \"uid\", 0, \"gid\", 0, \"fmode\", 0644, \"dmode\", 0755) == \"\");\n")
 	// Tell the user what is happening
 	buffer.WriteString("ui_print(\"Extracting ")
-	file.Mux.RLock()
 	buffer.WriteString(file.Destination)
-	file.Mux.RUnlock()
 	buffer.WriteString("\");\n")
 	// Extract the file and assert it was extracted successfully
 	buffer.WriteString("assert(package_extract_file(\"files/")
-	file.Mux.RLock()
 	buffer.WriteString(file.FileName)
-	file.Mux.RUnlock()
 	buffer.WriteString("\", \"")
-	file.Mux.RLock()
 	buffer.WriteString(file.Destination)
-	file.Mux.RUnlock()
 	buffer.WriteString("\") == \"t\");\n")
 	// Set metadata for the file and assert that was successful
 	buffer.WriteString("assert(set_metadata(\"")
-	file.Mux.RLock()
 	buffer.WriteString(file.Destination)
-	file.Mux.RUnlock()
 	buffer.WriteString("\", \"uid\", 0, \"gid\", 0, \"mode\", ")
-	file.Mux.RLock()
 	buffer.WriteString(file.Mode)
-	file.Mux.RUnlock()
 	buffer.WriteString(") == \"\");\n")
 }
 
-func makeFileDeleteScriptlet(filesToDelete map[string]bool, buffer *bytes.Buffer) {
-	for file := range filesToDelete {
-		// The weird spacing should cause a nice tree structure in the output
-		// The generated code should recursively delete directories and normal delete files
-		// TODO: Add output telling what is happening
-		buffer.WriteString("if run_program(\"/sbin/test\", \"-d\", \"")
-		buffer.WriteString(file)
-		buffer.WriteString("\") == 0 then\n    ui_print(\"Recursively deleting existing folder ")
-		buffer.WriteString(file)
-		buffer.WriteString("\") && delete_recursive(\"")
-		buffer.WriteString(file)
-		buffer.WriteString("\");\nelse\n    if run_program(\"/sbin/test\", \"-f\", \"")
-		buffer.WriteString(file)
-		buffer.WriteString("\") == 0 then\n        ui_print(\"Deleting existing file ")
-		buffer.WriteString(file)
-		buffer.WriteString("\") && delete(\"")
-		buffer.WriteString(file)
-		buffer.WriteString("\");\n    endif;\nendif;\n")
-	}
+func (edifyDialect) deleteFile(file string, buffer *bytes.Buffer) {
+	// The weird spacing should cause a nice tree structure in the output
+	// The generated code should recursively delete directories and normal delete files
+	buffer.WriteString("if " + shellCommand(`test -d "$1"`, file) + " == 0 then\n    ui_print(\"Recursively deleting existing folder ")
+	buffer.WriteString(file)
+	buffer.WriteString("\") && delete_recursive(\"")
+	buffer.WriteString(file)
+	buffer.WriteString("\");\nelse\n    if " + shellCommand(`test -f "$1"`, file) + " == 0 then\n        ui_print(\"Deleting existing file ")
+	buffer.WriteString(file)
+	buffer.WriteString("\") && delete(\"")
+	buffer.WriteString(file)
+	buffer.WriteString("\");\n    endif;\nendif;\n")
 }
 
-func processInstallFile(item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo, ver string, extractFiles *bytes.Buffer, verFilesToDelete *map[string]bool) {
-	if !item[ver].HasArchSpecificInfo {
-		if item[ver].Arch[lib.NOARCH].FileName != "" {
-			lib.Debug("INSTALLING: " + item[ver].Arch[lib.NOARCH].FileName)
-			makeFileInstallScriptlet(item[ver].Arch[lib.NOARCH], extractFiles)
-			for _, del := range item[ver].Arch[lib.NOARCH].InstallRemoveFiles {
-				lib.Debug("DELETE FILE (VERSION): " + del)
-				(*verFilesToDelete)[del] = true
-			}
-		}
-	} else {
-		for _, arch := range lib.Arches {
-			if item[ver].Arch[arch] != nil && item[ver].Arch[arch].FileName != "" {
-				lib.Debug("TESTING FOR ANDROID ARCH: " + arch)
-				extractFiles.WriteString("if is_substring(\"")
-				if arch == "arm" {
-					extractFiles.WriteString("armeabi")
-				} else {
-					extractFiles.WriteString(arch)
-				}
-				extractFiles.WriteString("\", getprop(\"ro.product.cpu.abilist\") + getprop(\"ro.product.cpu.abi\")) then\n")
-
-				archFilesToDelete := make(map[string]bool)
-				// Add any files that this app wants deleted
-				for _, del := range item[ver].Arch[arch].InstallRemoveFiles {
-					lib.Debug("DELETE FILE (ARCH): " + del)
-					archFilesToDelete[del] = true
-				}
-				makeFileDeleteScriptlet(archFilesToDelete, extractFiles)
-
-				lib.Debug("INSTALLING ITEM: " + item[ver].Arch[arch].FileName)
-				makeFileInstallScriptlet(item[ver].Arch[arch], extractFiles)
-				extractFiles.WriteString("endif;\n")
-			}
-		}
-	}
-}
-
-func makePerItemScriptlet(item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo, buff *bytes.Buffer) {
-	multVersionTest := ""
-	verFilesToDelete := make(map[string]bool)
-	var extractFiles bytes.Buffer
-	var deleteFiles bytes.Buffer
-
-	for i, ver := range append(zip.Versions, "") {
-		lib.Debug("ANDROID VERSION: " + ver)
-		testVersion := "is_substring(\"" + ver + "\", getprop(\"ro.build.version.release\"))"
-		if ver == "" || (item[ver] != nil && item[ver].Base != "") {
-			if ver == "" || item[ver].Base == ver || i == len(zip.Versions) {
-				if multVersionTest != "" && (deleteFiles.Len() > 0 || extractFiles.Len() > 0) {
-					buff.WriteString("if " + multVersionTest + " then\n")
-					makeFileDeleteScriptlet(verFilesToDelete, &deleteFiles)
-					buff.WriteString(deleteFiles.String())
-					buff.WriteString(extractFiles.String())
-					buff.WriteString("endif;\n")
-				}
-				// Clear vars
-				multVersionTest = testVersion
-				extractFiles.Reset()
-				deleteFiles.Reset()
-				if i < len(zip.Versions) {
-					processInstallFile(item, zip, ver, &extractFiles, &verFilesToDelete)
-				}
-			} else {
-				multVersionTest = multVersionTest + " || " + testVersion
-			}
-		}
-	}
-}
-
-func makeUpdaterScript(root string, zip *lib.ZipInfo, apps *lib.Apps, files *lib.Files) error {
-	fmt.Println("Generating updater-script")
-
-	var script bytes.Buffer
-
-	// TODO: Dynamically decide which partitions need to be mounted
-	script.WriteString(`ui_print("--------------------------------------");
-ui_print("Mounting system");
-ifelse(is_mounted("/system"), unmount("/system"));
-run_program("/sbin/mount", "/system");
-ui_print("Mounting data");
-ifelse(is_mounted("/data"), unmount("/data"));
-run_program("/sbin/mount", "/data");
-ui_print("Detected Android version: " + getprop("ro.build.version.release"));
-ui_print("Detected arch: " + getprop("ro.product.cpu.abilist") + " " + getprop("ro.product.cpu.abi"));
-`)
-
-	filesToDelete := make(map[string]bool)
-	zip.RLock()
-	for _, del := range zip.InstallRemoveFiles {
-		filesToDelete[del] = true
-	}
-	zip.RUnlock()
-	makeFileDeleteScriptlet(filesToDelete, &script)
-
-	zip.RLock()
-	zipApps := zip.Apps
-	zipFiles := zip.Files
-	zip.RUnlock()
-
-	for _, app := range zipApps {
-		apps.RLockApp(app)
-		if apps.App[app].PackageName != "" {
-			makePerItemScriptlet(apps.App[app].Android.Version, zip, &script)
-		}
-		apps.RUnlockApp(app)
-	}
-
-	var giveWarning bool
-	for _, file := range zipFiles {
-		files.RLockFile(file)
-		makePerItemScriptlet(files.File[file].Version, zip, &script)
-		files.RUnlockFile(file)
-
-		giveWarning = giveWarning || file == "permissions.xml" || file == "sysconfig.xml"
-	}
-
-	if giveWarning {
-		script.WriteString(`if run_program("/sbin/test", "-d", "/data/data") == 0 then
-	ui_print("---");
-	ui_print("|- WARNING:");
-	ui_print("|- It appears you have previously booted");
-	ui_print("|- into this system. This zip includes a");
-	ui_print("|- set of permissions to grant to installed");
-	ui_print("|- apps by default, however default");
-	ui_print("|- permissions are only applied on FIRST");
-	ui_print("|- boot. You will need to manually grant");
-	ui_print("|- permissions to these apps.");
-	ui_print("---");
-endif;
-`)
-	}
-
-	script.WriteString(`ui_print("Unmounting /system");
-ui_print("Done!");
-ui_print("--------------------------------------");
-unmount("/system");
-`)
-
+func (edifyDialect) write(root string, script []byte) error {
 	scriptDest := filepath.Join(root, "/META-INF/com/google/android")
 	err := os.MkdirAll(scriptDest, os.ModeDir|0755)
 	if err != nil {
@@ -218,7 +158,7 @@ unmount("/system");
 	}
 	scriptDest = filepath.Join(scriptDest, "updater-script")
 
-	err = ioutil.WriteFile(scriptDest, []byte(script.String()), 0644)
+	err = ioutil.WriteFile(scriptDest, script, 0644)
 	if err != nil {
 		return fmt.Errorf("Error while writing updater-script to %v:\n  %v", scriptDest, err)
 	}
@@ -6,22 +6,54 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-
-	"github.com/spf13/viper"
-	"gitlab.com/Shadow53/zip-builder/lib"
+	"time"
 )
 
-func zipFolder(root string, zipinfo *lib.ZipInfo) (string, error) {
-	zipinfo.RLock()
-	zipdest := filepath.Join(viper.GetString("destination"), zipinfo.Name+".zip")
-	zipinfo.RUnlock()
+// Zip entries get this timestamp unless SOURCE_DATE_EPOCH is set, the same
+// one Android's build uses for signed zips
+var defaultZipTime = time.Date(2008, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// zipTime returns the timestamp of every zip entry, so building the same
+// zip twice gives the same bytes
+func zipTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return defaultZipTime, nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid SOURCE_DATE_EPOCH %v:\n  %v", epoch, err)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// zipMode normalizes permissions, keeping only whether a file is executable
+func zipMode(info os.FileInfo) os.FileMode {
+	if info.IsDir() {
+		return os.ModeDir | 0755
+	}
+	if info.Mode()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// zipFolder archives root into <name>.zip in the destination folder. Entries
+// are added in lexical order with normalized timestamps and permissions.
+func (b *Builder) zipFolder(root, name string) (string, error) {
+	zipdest := filepath.Join(b.opts.Destination, name+".zip")
+	modified, err := zipTime()
+	if err != nil {
+		return "", err
+	}
 
 	fmt.Println("Creating zip file at " + zipdest)
 	// Create destination directory if it doesn't exist
-	err := os.MkdirAll(viper.GetString("destination"), os.ModeDir|0755)
+	err = os.MkdirAll(b.opts.Destination, os.ModeDir|0755)
 	if err != nil {
-		return "", fmt.Errorf("Error while making directory %v:\n  %v", viper.GetString("destination"), err)
+		return "", fmt.Errorf("Error while making directory %v:\n  %v", b.opts.Destination, err)
 	}
 
 	zipfile, err := os.Create(zipdest)
@@ -29,16 +61,15 @@ func zipFolder(root string, zipinfo *lib.ZipInfo) (string, error) {
 		return "", fmt.Errorf("Error while creating target zip file %v:\n  %v", zipdest, err)
 	}
 
-	defer fmt.Println("Zip file created")
-	defer zipfile.Close()
-
 	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
-
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("Error while zipping file %v into %v:\n  %v", path, zipdest, err)
 		}
+		// The root itself would become an entry named "/"
+		if path == root {
+			return nil
+		}
 
 		header, err := zip.FileInfoHeader(info)
 		if err != nil {
@@ -47,6 +78,8 @@ func zipFolder(root string, zipinfo *lib.ZipInfo) (string, error) {
 
 		header.Name = strings.TrimPrefix(path, root)
 		header.Name = strings.TrimPrefix(header.Name, "/")
+		header.Modified = modified
+		header.SetMode(zipMode(info))
 
 		if info.IsDir() {
 			header.Name += "/"
@@ -75,5 +108,22 @@ func zipFolder(root string, zipinfo *lib.ZipInfo) (string, error) {
 		}
 		return nil
 	})
+	if err != nil {
+		zipfile.Close()
+		return "", err
+	}
+
+	// Closing writes the central directory, so errors here mean a truncated
+	// zip that must not be signed
+	err = archive.Close()
+	if err != nil {
+		zipfile.Close()
+		return "", fmt.Errorf("Error while finishing %v:\n  %v", zipdest, err)
+	}
+	err = zipfile.Close()
+	if err != nil {
+		return "", fmt.Errorf("Error while closing %v:\n  %v", zipdest, err)
+	}
+	fmt.Println("Zip file created")
 	return zipdest, nil
 }
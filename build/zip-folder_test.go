@@ -0,0 +1,74 @@
+package build
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipFolder(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "META-INF", "com"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]os.FileMode{"META-INF/com/script": 0700, "files/b.apk": 0600, "files/a.apk": 0664} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := New(Options{Destination: t.TempDir()})
+
+	var builds [][]byte
+	for i := 0; i < 2; i++ {
+		path, err := b.zipFolder(root, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		builds = append(builds, data)
+		// Later builds of the same tree must not depend on file times
+		later := defaultZipTime.AddDate(1, 0, 0)
+		os.Chtimes(filepath.Join(root, "files", "a.apk"), later, later)
+	}
+	if !bytes.Equal(builds[0], builds[1]) {
+		t.Error("building the same folder twice gave different zips")
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(builds[0]), int64(len(builds[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range r.File {
+		names = append(names, file.Name)
+		if !file.Modified.Equal(defaultZipTime) {
+			t.Errorf("%v has timestamp %v", file.Name, file.Modified)
+		}
+	}
+	expected := []string{"META-INF/", "META-INF/com/", "META-INF/com/script", "files/", "files/a.apk", "files/b.apk"}
+	if len(names) != len(expected) {
+		t.Fatalf("zip contains %q, expected %q", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("zip contains %q, expected %q", names, expected)
+		}
+	}
+	if mode := r.File[2].Mode(); mode != 0755 {
+		t.Errorf("executable script has mode %v", mode)
+	}
+	if mode := r.File[4].Mode(); mode != 0644 {
+		t.Errorf("file has mode %v", mode)
+	}
+}
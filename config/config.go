@@ -1,11 +1,16 @@
 package config
 
 import (
+	"encoding/hex"
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
 	"github.com/spf13/viper"
+	"gitlab.com/Shadow53/zip-builder/dl"
+	"gitlab.com/Shadow53/zip-builder/jar"
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
@@ -18,6 +23,7 @@ func parseFileConfig(file map[string]interface{}) *lib.FileInfo {
 	}
 	return &lib.FileInfo{
 		Url:                lib.StringOrDefault(file["url"], ""),
+		Mirrors:            lib.StringSliceOrNil(file["mirrors"]),
 		Destination:        dest,
 		InstallRemoveFiles: append(lib.StringSliceOrNil(file["remove_files"]), lib.StringSliceOrNil(file["install_remove_files"])...),
 		UpdateRemoveFiles:  append(lib.StringSliceOrNil(file["remove_files"]), lib.StringSliceOrNil(file["update_remove_files"])...),
@@ -25,12 +31,15 @@ func parseFileConfig(file map[string]interface{}) *lib.FileInfo {
 		SHA1:               lib.StringOrDefault(file["sha1"], ""),
 		SHA256:             lib.StringOrDefault(file["sha256"], ""),
 		Mode:               lib.StringOrDefault(file["mode"], "0644"),
+		Version:            lib.StringOrDefault(file["version"], ""),
+		VersionCode:        lib.IntOrDefault(file["version_code"], 0),
 		FileName:           name}
 }
 
 func mergeFileConfig(file *lib.FileInfo, toMerge *lib.FileInfo) {
 	if file.Url == "" {
 		file.Url = toMerge.Url
+		file.Mirrors = toMerge.Mirrors
 		file.MD5 = toMerge.MD5
 		file.SHA1 = toMerge.SHA1
 		file.SHA256 = toMerge.SHA256
@@ -50,20 +59,33 @@ func mergeFileConfig(file *lib.FileInfo, toMerge *lib.FileInfo) {
 	if file.FileName == "" {
 		file.FileName = toMerge.FileName
 	}
+	if file.Version == "" {
+		file.Version = toMerge.Version
+	}
+	if file.VersionCode == 0 {
+		file.VersionCode = toMerge.VersionCode
+	}
 }
 
-func parseAndroidVersionConfig(item map[string]interface{}) (map[string]*lib.AndroidVersionInfo, error) {
+func parseAndroidVersionConfig(item map[string]interface{}, versions *lib.VersionTable) (map[string]*lib.AndroidVersionInfo, error) {
 	versionInfo := make(map[string]*lib.AndroidVersionInfo)
 	var versionSet bool
 	var versionsArr, hasVersions = item["androidversion"].([]interface{})
 	if !hasVersions {
 		return nil, fmt.Errorf("%v must have at least one \"androidversion\" configured", item["name"])
 	}
+	for _, verInterface := range versionsArr {
+		if version, ok := verInterface.(map[string]interface{}); ok {
+			if ver := versions.VersionOrDefault(version["number"], ""); ver != "" && versions.SdkLevel(ver) == 0 {
+				return nil, fmt.Errorf("Unknown Android version %v on %v, add it to \"android_versions\" with its API level", ver, item["name"])
+			}
+		}
+	}
 	appConfig := parseFileConfig(item)
-	for i, ver := range lib.Versions {
+	for i, ver := range versions.Versions {
 		for _, verInterface := range versionsArr {
 			version, versionOk := verInterface.(map[string]interface{})
-			if versionOk && lib.StringOrDefault(version["number"], "") == ver {
+			if versionOk && versions.VersionOrDefault(version["number"], "") == ver {
 				versionSet = true
 				vConfig := parseFileConfig(version)
 				info := lib.AndroidVersionInfo{Base: ver, Arch: make(map[string]*lib.FileInfo)}
@@ -105,7 +127,7 @@ func parseAndroidVersionConfig(item map[string]interface{}) (map[string]*lib.And
 				}
 
 				// Set values for this and later Android versions
-				for _, ver2 := range lib.Versions[i:] {
+				for _, ver2 := range versions.Versions[i:] {
 					versionInfo[ver2] = &info
 				}
 			} else if !versionOk {
@@ -119,18 +141,37 @@ func parseAndroidVersionConfig(item map[string]interface{}) (map[string]*lib.And
 	return versionInfo, nil
 }
 
-func parseAppConfig(app map[string]interface{}) (*lib.AppInfo, error) {
+func parseAppConfig(app map[string]interface{}, versions *lib.VersionTable) (*lib.AppInfo, error) {
 	appInfo := lib.AppInfo{
 		PackageName:             lib.StringOrDefault(app["package_name"], ""),
 		UrlIsFDroidRepo:         lib.BoolOrDefault(app["is_fdroid_repo"], false),
+		FDroidIndex:             lib.StringOrDefault(app["fdroid_index"], dl.FDroidIndexAuto),
+		FDroidFingerprint:       lib.StringOrDefault(app["fdroid_fingerprint"], ""),
+		SignerSHA256:            lib.StringSliceOrNil(app["signer_sha256"]),
 		DozeWhitelist:           lib.BoolOrDefault(app["doze_whitelist"], false),
 		DozeWhitelistExceptIdle: lib.BoolOrDefault(app["doze_whitelist_except_idle"], false),
 		DataSaverWhitelist:      lib.BoolOrDefault(app["data_saver_whitelist"], false),
 		AllowSystemUser:         lib.BoolOrDefault(app["grant_system_user"], false),
 		BlacklistSystemUser:     lib.BoolOrDefault(app["blacklist_system_user"], false),
-		Permissions:             lib.StringSliceOrNil(app["permissions"])}
+		Permissions:             lib.StringSliceOrNil(app["permissions"]),
+		PrivilegedPermissions:   lib.StringSliceOrNil(app["privileged_permissions"])}
+
+	switch appInfo.FDroidIndex {
+	case dl.FDroidIndexAuto, dl.FDroidIndexXML, dl.FDroidIndexV1, dl.FDroidIndexV2:
+	default:
+		return &appInfo, fmt.Errorf("Unknown \"fdroid_index\" %v, expected one of %v, %v, %v or %v", appInfo.FDroidIndex,
+			dl.FDroidIndexAuto, dl.FDroidIndexXML, dl.FDroidIndexV1, dl.FDroidIndexV2)
+	}
 
-	androidVersion, err := parseAndroidVersionConfig(app)
+	for i, fingerprint := range appInfo.SignerSHA256 {
+		appInfo.SignerSHA256[i] = jar.NormalizeFingerprint(fingerprint)
+		if _, err := hex.DecodeString(appInfo.SignerSHA256[i]); err != nil || len(appInfo.SignerSHA256[i]) != 64 {
+			return &appInfo, fmt.Errorf("Invalid \"signer_sha256\" %v on %v: expected a SHA-256 in hex", fingerprint, appInfo.PackageName)
+		}
+	}
+	sort.Strings(appInfo.SignerSHA256)
+
+	androidVersion, err := parseAndroidVersionConfig(app, versions)
 	if err != nil {
 		return &appInfo, fmt.Errorf("Error while parsing Android version information:\n  %v", err)
 	}
@@ -138,7 +179,32 @@ func parseAppConfig(app map[string]interface{}) (*lib.AppInfo, error) {
 	return &appInfo, nil
 }
 
-func parseZipConfig(zip map[string]interface{}) lib.ZipInfo {
+// configRelativePath reads a path that is relative to dir, the folder of the
+// config file
+func configRelativePath(item interface{}, dir string) string {
+	path := lib.StringOrDefault(item, "")
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+// Magisk module ids, as checked by Magisk when installing
+var (
+	validModuleId  = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]+$`)
+	invalidIdChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+// moduleIdFromName makes a valid Magisk module id out of a zip name
+func moduleIdFromName(name string) string {
+	id := invalidIdChars.ReplaceAllString(name, "_")
+	if !validModuleId.MatchString(id) {
+		id = "zip_" + id
+	}
+	return id
+}
+
+func parseZipConfig(zip map[string]interface{}, dir string, table *lib.VersionTable) (*lib.ZipInfo, error) {
 	arches := lib.StringSliceOrNil(zip["arches"])
 	if arches == nil {
 		arches = lib.Arches
@@ -147,33 +213,155 @@ func parseZipConfig(zip map[string]interface{}) lib.ZipInfo {
 		arches = lib.StringIntersection(lib.Arches, arches)
 	}
 
-	versions := lib.StringSliceOrNil(zip["versions"])
-	if versions == nil {
-		versions = lib.Versions
-	} else {
-		sort.Strings(versions)
-		versions = lib.StringIntersection(lib.Versions, versions)
+	// Each zip has its own copy, which later changes to the table cannot
+	// reorder
+	versions := append([]string(nil), table.Versions...)
+	if configVersions, ok := zip["versions"].([]interface{}); ok {
+		var wanted []string
+		for _, ver := range configVersions {
+			wanted = append(wanted, table.VersionOrDefault(ver, ""))
+		}
+		versions = table.FilterVersions(wanted)
+	}
+
+	updateBinary := configRelativePath(zip["update_binary"], dir)
+	signingKey := configRelativePath(zip["signing_key"], dir)
+	signingCert := configRelativePath(zip["signing_cert"], dir)
+	if (signingKey == "") != (signingCert == "") {
+		return nil, fmt.Errorf("\"signing_key\" and \"signing_cert\" must be used together on zip %v", zip["name"])
+	}
+
+	installer := lib.StringOrDefault(zip["installer"], lib.InstallerEdify)
+	switch installer {
+	case lib.InstallerEdify:
+	case lib.InstallerShell:
+		if updateBinary != "" {
+			return nil, fmt.Errorf("\"update_binary\" cannot be used with the %v installer on zip %v", installer, zip["name"])
+		}
+	default:
+		return nil, fmt.Errorf("Unknown \"installer\" %v on zip %v, expected %v or %v", installer, zip["name"],
+			lib.InstallerEdify, lib.InstallerShell)
+	}
+
+	name := lib.StringOrDefault(zip["name"], "")
+	output := lib.StringOrDefault(zip["output"], lib.OutputRecovery)
+	switch output {
+	case lib.OutputRecovery:
+	case lib.OutputMagisk:
+		// Magisk installs modules with its own installer
+		if zip["installer"] != nil || updateBinary != "" {
+			return nil, fmt.Errorf("\"installer\" and \"update_binary\" cannot be used with %v output on zip %v", output, name)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown \"output\" %v on zip %v, expected %v or %v", output, name,
+			lib.OutputRecovery, lib.OutputMagisk)
 	}
 
-	return lib.ZipInfo{
-		Name:               lib.StringOrDefault(zip["name"], ""),
+	// Magisk removes everything a module installed by itself
+	uninstaller := lib.BoolOrDefault(zip["uninstaller"], false)
+	if uninstaller && output == lib.OutputMagisk {
+		return nil, fmt.Errorf("\"uninstaller\" cannot be used with %v output on zip %v", output, name)
+	}
+
+	moduleId := lib.StringOrDefault(zip["module_id"], moduleIdFromName(name))
+	if output == lib.OutputMagisk && !validModuleId.MatchString(moduleId) {
+		return nil, fmt.Errorf("Invalid \"module_id\" %v on zip %v: must start with a letter and contain only letters, numbers, \".\", \"_\" and \"-\"",
+			moduleId, name)
+	}
+
+	return &lib.ZipInfo{
+		Name:               name,
+		Installer:          installer,
+		Output:             output,
+		Uninstaller:        uninstaller,
+		SigningKey:         signingKey,
+		SigningCert:        signingCert,
+		ModuleId:           moduleId,
+		ModuleVersion:      lib.StringOrDefault(zip["module_version"], "1.0"),
+		ModuleVersionCode:  lib.IntOrDefault(zip["module_version_code"], 1),
+		ModuleAuthor:       lib.StringOrDefault(zip["module_author"], "zip-builder"),
+		ModuleDescription:  lib.StringOrDefault(zip["module_description"], "Built by zip-builder"),
+		UpdateBinary:       updateBinary,
+		UpdateBinarySHA256: lib.StringOrDefault(zip["update_binary_sha256"], ""),
 		InstallRemoveFiles: append(lib.StringSliceOrNil(zip["remove_files"]), lib.StringSliceOrNil(zip["install_remove_files"])...),
 		UpdateRemoveFiles:  append(lib.StringSliceOrNil(zip["remove_files"]), lib.StringSliceOrNil(zip["update_remove_files"])...),
 		Arches:             arches,
 		Versions:           versions,
 		Apps:               lib.StringSliceOrNil(zip["apps"]),
-		Files:              lib.StringSliceOrNil(zip["files"])}
+		Files:              lib.StringSliceOrNil(zip["files"])}, nil
+}
+
+// parseVersionTable returns the built-in Android versions along with the
+// ones in "android_versions", a map of version names to API levels
+func parseVersionTable(v *viper.Viper) (*lib.VersionTable, error) {
+	versions := lib.NewVersionTable()
+	if v.Get("android_versions") == nil {
+		return versions, nil
+	}
+	table, ok := v.Get("android_versions").(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Could not parse \"android_versions\" as a map of versions to API levels")
+	}
+	for ver, sdk := range table {
+		level := lib.IntOrDefault(sdk, 0)
+		if level <= 0 {
+			return nil, fmt.Errorf("Invalid API level %v for Android version %v", sdk, ver)
+		}
+		lib.Debug(fmt.Sprintf("ANDROID VERSION %v IS API LEVEL %v", ver, level))
+		versions.SetVersion(ver, level)
+	}
+	return versions, nil
+}
+
+// Config is a parsed configuration file. It is not changed once loaded.
+type Config struct {
+	Zips     []*lib.ZipInfo
+	Apps     *lib.Apps
+	Files    *lib.Files
+	Versions *lib.VersionTable // The Android versions known to this configuration
+}
+
+// Load reads and parses the configuration file at path. Without a path, the
+// file called "build" in the current folder is used, with any extension viper
+// supports.
+func Load(path string) (*Config, error) {
+	v := viper.New()
+	if path == "" {
+		v.SetConfigName("build")
+		v.AddConfigPath(".")
+	} else {
+		v.SetConfigFile(path)
+	}
+
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading the configuration file:\n  %v", err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(v.ConfigFileUsed()))
+	if err != nil {
+		return nil, fmt.Errorf("Error while converting %v to an absolute path:\n  %v", v.ConfigFileUsed(), err)
+	}
+	versions, err := parseVersionTable(v)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred while building configuration:\n  %v", err)
+	}
+	zips, apps, files, err := parseConfig(v, dir, versions)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred while building configuration:\n  %v", err)
+	}
+	return &Config{Zips: zips, Apps: apps, Files: files, Versions: versions}, nil
 }
 
 // TODO: Throw exceptions if values are not as expected
-func MakeConfig() ([]lib.ZipInfo, *lib.Apps, *lib.Files, error) {
+func parseConfig(v *viper.Viper, dir string, versions *lib.VersionTable) ([]*lib.ZipInfo, *lib.Apps, *lib.Files, error) {
 	// Read data from config into memory
 	fmt.Println("Loading configuration...")
 
 	apps := &lib.Apps{}
 	apps.App = make(map[string]*lib.AppInfo)
-	if viper.Get("apps") != nil {
-		configApps, appsOk := viper.Get("apps").([]interface{})
+	if v.Get("apps") != nil {
+		configApps, appsOk := v.Get("apps").([]interface{})
 		if appsOk {
 			for _, a := range configApps {
 				app, appOk := a.(map[string]interface{})
@@ -184,7 +372,7 @@ func MakeConfig() ([]lib.ZipInfo, *lib.Apps, *lib.Files, error) {
 					} else if lib.StringOrDefault(app["package_name"], "") == "" {
 						return nil, &lib.Apps{}, &lib.Files{}, fmt.Errorf("App %v is missing \"package_name\" parameter", appName)
 					} else {
-						app, err := parseAppConfig(app)
+						app, err := parseAppConfig(app, versions)
 						if err != nil {
 							return nil, &lib.Apps{}, &lib.Files{}, fmt.Errorf("Error while parsing app config for %v:\n  %v", appName, err)
 						}
@@ -201,14 +389,14 @@ func MakeConfig() ([]lib.ZipInfo, *lib.Apps, *lib.Files, error) {
 
 	files := &lib.Files{}
 	files.File = make(map[string]*lib.AndroidVersions)
-	if viper.Get("files") != nil {
-		configFiles, filesOk := viper.Get("files").([]interface{})
+	if v.Get("files") != nil {
+		configFiles, filesOk := v.Get("files").([]interface{})
 		if filesOk {
 			for _, f := range configFiles {
 				file := f.(map[string]interface{})
 				name := lib.StringOrDefault(file["name"], "")
 				if name != "" {
-					fileConfig, err := parseAndroidVersionConfig(file)
+					fileConfig, err := parseAndroidVersionConfig(file, versions)
 					if err == nil {
 						files.File[name] = &lib.AndroidVersions{}
 						files.File[name].Version = fileConfig
@@ -226,14 +414,18 @@ func MakeConfig() ([]lib.ZipInfo, *lib.Apps, *lib.Files, error) {
 		lib.Debug("No file installation configurations found")
 	}
 
-	var zips []lib.ZipInfo
-	if viper.Get("zips") != nil {
-		configZips, zipsOk := viper.Get("zips").([]interface{})
+	var zips []*lib.ZipInfo
+	if v.Get("zips") != nil {
+		configZips, zipsOk := v.Get("zips").([]interface{})
 		if zipsOk {
 			for _, z := range configZips {
 				zip, zipOk := z.(map[string]interface{})
 				if zipOk {
-					zips = append(zips, parseZipConfig(zip))
+					zipInfo, err := parseZipConfig(zip, dir, versions)
+					if err != nil {
+						return nil, &lib.Apps{}, &lib.Files{}, err
+					}
+					zips = append(zips, zipInfo)
 				} else {
 					return nil, &lib.Apps{}, &lib.Files{}, fmt.Errorf("Could not parse zip as configuration map")
 				}
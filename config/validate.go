@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Validate checks what Load cannot check while parsing each item on its
+// own: that zips have unique names and only use apps and files that are
+// defined. All problems are returned, not just the first.
+func (c *Config) Validate() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, zip := range c.Zips {
+		if zip.Name == "" {
+			errs = append(errs, fmt.Errorf("Zip #%v does not have a \"name\" set", i+1))
+			continue
+		}
+		if names[zip.Name] {
+			errs = append(errs, fmt.Errorf("More than one zip is named %v", zip.Name))
+		}
+		names[zip.Name] = true
+
+		for _, app := range zip.Apps {
+			if !c.Apps.AppExists(app) {
+				errs = append(errs, fmt.Errorf("Zip %v uses app %v, which is not defined in \"apps\"", zip.Name, app))
+			}
+		}
+		for _, file := range zip.Files {
+			if !c.Files.FileExists(file) {
+				errs = append(errs, fmt.Errorf("Zip %v uses file %v, which is not defined in \"files\"", zip.Name, file))
+			}
+		}
+		if len(zip.Versions) == 0 {
+			errs = append(errs, fmt.Errorf("Zip %v has no known Android versions to build for", zip.Name))
+		}
+		if len(zip.Arches) == 0 {
+			errs = append(errs, fmt.Errorf("Zip %v has no known architectures to build for", zip.Name))
+		}
+	}
+	return errs
+}
+
+// SelectZips returns the zips named in names, or every named zip if names is
+// empty. A zip named more than once is only selected once.
+func (c *Config) SelectZips(names []string) ([]*lib.ZipInfo, error) {
+	var selected []*lib.ZipInfo
+	if len(names) == 0 {
+		for _, zip := range c.Zips {
+			if zip.Name != "" {
+				selected = append(selected, zip)
+			}
+		}
+		return selected, nil
+	}
+
+	var unknown []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		found := false
+		for _, zip := range c.Zips {
+			if zip.Name == name {
+				selected = append(selected, zip)
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		var known []string
+		for _, zip := range c.Zips {
+			if zip.Name != "" {
+				known = append(known, zip.Name)
+			}
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("No zip named %v in the configuration, known zips are: %v",
+			strings.Join(unknown, ", "), strings.Join(known, ", "))
+	}
+	return selected, nil
+}
@@ -0,0 +1,237 @@
+package dl
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// The cache is content-addressed: every downloaded file is stored once under
+// blobs/ by its SHA-256, and sources/ maps a key built from the URL and the
+// checksums it is expected to have to the blob that satisfied it.
+//
+// Sources without any expected checksum (F-Droid indexes, "latest" URLs) may
+// change upstream, so they are only reused for Options.CacheMaxAge.
+
+type cacheEntry struct {
+	Url     string    `json:"url"`
+	MD5     string    `json:"md5,omitempty"`
+	SHA1    string    `json:"sha1,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Blob    string    `json:"blob"`
+	Fetched time.Time `json:"fetched"`
+}
+
+var (
+	// One lock per cache key so that zips sharing an app wait for a single
+	// download instead of each fetching their own copy. These are shared by
+	// every Downloader, since they may use the same cache directory.
+	keyLocks    = make(map[string]*sync.Mutex)
+	keyLocksMux sync.Mutex
+)
+
+func lockKey(key string) func() {
+	keyLocksMux.Lock()
+	mux, ok := keyLocks[key]
+	if !ok {
+		mux = &sync.Mutex{}
+		keyLocks[key] = mux
+	}
+	keyLocksMux.Unlock()
+	mux.Lock()
+	return mux.Unlock
+}
+
+func (d *Downloader) cacheEnabled() bool {
+	return d.opts.CacheDir != ""
+}
+
+func cacheKey(src string, sums lib.Checksums) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		src,
+		strings.ToLower(sums.MD5),
+		strings.ToLower(sums.SHA1),
+		strings.ToLower(sums.SHA256)}, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Downloader) entryPath(key string) string {
+	return filepath.Join(d.opts.CacheDir, "sources", key[:2], key+".json")
+}
+
+func (d *Downloader) blobPath(digest string) string {
+	return filepath.Join(d.opts.CacheDir, "blobs", digest[:2], digest)
+}
+
+// hashFile computes every digest needed to verify a file in one pass
+func hashFile(path string) (lib.Checksums, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return lib.Checksums{}, fmt.Errorf("Error while opening %v for reading:\n  %v", path, err)
+	}
+	defer file.Close()
+
+	md5sum, sha1sum, sha256sum := md5.New(), sha1.New(), sha256.New()
+	_, err = io.Copy(io.MultiWriter(md5sum, sha1sum, sha256sum), file)
+	if err != nil {
+		return lib.Checksums{}, fmt.Errorf("Error while reading %v:\n  %v", path, err)
+	}
+	return lib.Checksums{
+		MD5:    hex.EncodeToString(md5sum.Sum(nil)),
+		SHA1:   hex.EncodeToString(sha1sum.Sum(nil)),
+		SHA256: hex.EncodeToString(sha256sum.Sum(nil))}, nil
+}
+
+// matchesChecksums reports whether actual satisfies every checksum set in expected
+func matchesChecksums(expected, actual lib.Checksums) bool {
+	return (expected.MD5 == "" || strings.EqualFold(expected.MD5, actual.MD5)) &&
+		(expected.SHA1 == "" || strings.EqualFold(expected.SHA1, actual.SHA1)) &&
+		(expected.SHA256 == "" || strings.EqualFold(expected.SHA256, actual.SHA256))
+}
+
+// lookupCache returns the path of a verified cached copy of src, or "" if
+// there is no usable entry. Entries that fail verification are removed.
+func (d *Downloader) lookupCache(key string, sums lib.Checksums, ignoreAge bool) string {
+	data, err := ioutil.ReadFile(d.entryPath(key))
+	if err != nil {
+		return ""
+	}
+
+	var entry cacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil || len(entry.Blob) < 2 {
+		lib.Debug("REMOVING UNREADABLE CACHE ENTRY " + d.entryPath(key))
+		os.Remove(d.entryPath(key))
+		return ""
+	}
+
+	maxAge := d.opts.CacheMaxAge
+	if sums.IsEmpty() && !ignoreAge && maxAge > 0 && time.Since(entry.Fetched) > maxAge {
+		lib.Debug("CACHE ENTRY FOR " + entry.Url + " HAS EXPIRED")
+		return ""
+	}
+
+	path := d.blobPath(entry.Blob)
+	actual, err := hashFile(path)
+	if err != nil {
+		lib.Debug("CACHED BLOB MISSING FOR " + entry.Url)
+		os.Remove(d.entryPath(key))
+		return ""
+	}
+	if actual.SHA256 != entry.Blob || !matchesChecksums(sums, actual) {
+		lib.Debug("CACHED BLOB FOR " + entry.Url + " FAILED VERIFICATION, REMOVING")
+		os.Remove(path)
+		os.Remove(d.entryPath(key))
+		return ""
+	}
+	return path
+}
+
+// storeCache moves the file at tmp into the blob store and records it as the
+// content for key. The file must satisfy sums, otherwise it is not cached.
+func (d *Downloader) storeCache(key, src string, sums lib.Checksums, tmp string) (string, error) {
+	actual, err := hashFile(tmp)
+	if err != nil {
+		return "", err
+	}
+	if !matchesChecksums(sums, actual) {
+		return "", fmt.Errorf("Downloaded file from %v does not match the expected checksums", src)
+	}
+
+	blob := d.blobPath(actual.SHA256)
+	err = os.MkdirAll(filepath.Dir(blob), os.ModeDir|0755)
+	if err != nil {
+		return "", fmt.Errorf("Error while creating directory %v:\n  %v", filepath.Dir(blob), err)
+	}
+	err = os.Rename(tmp, blob)
+	if err != nil {
+		return "", fmt.Errorf("Error while moving %v into the cache at %v:\n  %v", tmp, blob, err)
+	}
+
+	entry := cacheEntry{
+		Url:     src,
+		MD5:     sums.MD5,
+		SHA1:    sums.SHA1,
+		SHA256:  sums.SHA256,
+		Blob:    actual.SHA256,
+		Fetched: time.Now().UTC()}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Error while encoding cache entry for %v:\n  %v", src, err)
+	}
+
+	path := d.entryPath(key)
+	err = os.MkdirAll(filepath.Dir(path), os.ModeDir|0755)
+	if err != nil {
+		return "", fmt.Errorf("Error while creating directory %v:\n  %v", filepath.Dir(path), err)
+	}
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error while writing cache entry %v:\n  %v", path, err)
+	}
+	return blob, nil
+}
+
+// copyFile copies src to dest through a temporary file in the same directory
+// so that readers of dest never see a partially written file
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Error while opening %v for reading:\n  %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dest), ".zip-builder-")
+	if err != nil {
+		return fmt.Errorf("Error while creating a file at %v:\n  %v", dest, err)
+	}
+
+	_, err = io.Copy(out, in)
+	out.Close()
+	if err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("Error while copying %v to %v:\n  %v", src, dest, err)
+	}
+
+	err = os.Rename(out.Name(), dest)
+	if err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("Error while moving temporary file from %v to %v:\n  %v", out.Name(), dest, err)
+	}
+	return nil
+}
+
+// KnownDigest returns the SHA-256 of the file Download would give for src
+// and sums without downloading it: the pinned SHA-256, or that of a usable
+// cached copy
+func (d *Downloader) KnownDigest(src string, sums lib.Checksums) (string, bool) {
+	if sums.SHA256 != "" {
+		return strings.ToLower(sums.SHA256), true
+	}
+	if !d.cacheEnabled() {
+		return "", false
+	}
+	key := cacheKey(src, sums)
+	unlock := lockKey(key)
+	defer unlock()
+	cached := d.lookupCache(key, sums, d.opts.Offline)
+	if cached == "" {
+		return "", false
+	}
+	return filepath.Base(cached), true
+}
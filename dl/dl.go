@@ -1,148 +1,119 @@
 package dl
 
 import (
-	"encoding/xml"
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/spf13/viper"
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
-func Download(src, dest string) error {
-	fmt.Println("Downloading " + src)
-	lib.Debug("SOURCE URL: " + src)
-	lib.Debug("DESTINATION: " + dest)
-
-	out, err := ioutil.TempFile(viper.GetString("tempdir"), "zip-builder-")
-	if err != nil {
-		return fmt.Errorf("Error while creating a file at %v:\n  %v", dest, err)
-	}
-	defer out.Close()
-
-	resp, err := http.Get(src)
-	if err != nil {
-		return fmt.Errorf("Error while setting up a connection to %v:\n  %v", src, err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("Error while connecting to %v:\n  Received non-ok status code %v", src, resp.StatusCode)
-	}
-
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return fmt.Errorf("Error while writing to the file at %v:\n  %v", dest, err)
+// fetchMirrors downloads src, or the same file from one of its mirrors, into
+// a new temporary file inside dir. Mirrors are tried in order when the
+// download fails or, if sums is set, has the wrong checksums. The last
+// download is returned even with wrong checksums so the caller reports it.
+func (d *Downloader) fetchMirrors(ctx context.Context, src string, mirrors []string, dir string, sums lib.Checksums) (string, error) {
+	urls := append([]string{src}, mirrors...)
+	var errs []string
+	for i, u := range urls {
+		fmt.Println("Downloading " + u)
+		tmp, err := d.fetch(ctx, u, dir)
+		if err == nil && i < len(urls)-1 && !sums.IsEmpty() {
+			actual, hashErr := hashFile(tmp)
+			if hashErr != nil || !matchesChecksums(sums, actual) {
+				os.Remove(tmp)
+				err = fmt.Errorf("Downloaded %v does not match the configured checksums", u)
+			}
+		}
+		if err == nil {
+			return tmp, nil
+		}
+		if ctx.Err() != nil {
+			// Mirrors were not tried because of the cancellation, not
+			// because they failed
+			return "", err
+		}
+		errs = append(errs, err.Error())
 	}
-
-	err = os.Rename(out.Name(), dest)
-	if err != nil {
-		return fmt.Errorf("Error while moving temporary file from %v to %v:\n  %v", out.Name(), dest, err)
+	if len(errs) == 1 {
+		return "", fmt.Errorf("%v", errs[0])
 	}
-
-	return nil
+	return "", fmt.Errorf("Could not download %v from it or any mirror:\n  %v", src, strings.Join(errs, "\n  "))
 }
 
-func getFDroidRepoIndex(urlstr string) (string, error) {
-	url, err := url.Parse(urlstr)
-	if err != nil {
-		return "", fmt.Errorf("Error while parsing %v as a URL:\n  %v", urlstr, err)
+// mirrorUrls returns the URLs of name in each mirror of a repository
+func mirrorUrls(mirrors []string, name string) []string {
+	var urls []string
+	for _, mirror := range mirrors {
+		urls = append(urls, strings.TrimSuffix(mirror, "/")+"/"+strings.TrimPrefix(name, "/"))
 	}
-	dest := filepath.Join(viper.GetString("tempdir"), url.Host+".xml")
-	return dest, Download(urlstr+"/index.xml", dest)
-}
-
-type FDroidHash struct {
-	Type string `xml:"type,attr"`
-	Hash string `xml:",chardata"`
+	return urls
 }
 
-type FDroidApk struct {
-	Version     string     `xml:"version"`
-	FileName    string     `xml:"apkname"`
-	Hash        FDroidHash `xml:"hash"`
-	Permissions string     `xml:"permissions"`
+// Download saves the file at src, or one of its mirrors, to dest. When a
+// cache directory is configured, a cached copy matching sums is used instead
+// of the network and fresh downloads are added to the cache. In offline mode
+// only the cache and the vendor directory are used.
+func (d *Downloader) Download(ctx context.Context, src, dest string, sums lib.Checksums, mirrors ...string) error {
+	err := d.download(ctx, src, dest, sums, mirrors...)
+	if _, ok := err.(*offlineError); ok {
+		d.recordMissing(src)
+	}
+	return err
 }
 
-type FDroidApp struct {
-	Id   string      `xml:"id,attr"`
-	Name string      `xml:"name"`
-	Apks []FDroidApk `xml:"package"`
-}
+// download is Download without recording missing files, for callers that
+// have other sources to try first
+func (d *Downloader) download(ctx context.Context, src, dest string, sums lib.Checksums, mirrors ...string) error {
+	lib.Debug("SOURCE URL: " + src)
+	lib.Debug("DESTINATION: " + dest)
 
-type FDroidRepo struct {
-	XMLName xml.Name    `xml:"fdroid"`
-	Apps    []FDroidApp `xml:"application"`
-}
+	if d.opts.Offline {
+		return d.resolveOffline(src, dest, sums)
+	}
 
-func DownloadFromFDroidRepo(app *lib.AppInfo, zip *lib.ZipInfo, ver, arch, dest string) error {
-	lib.Debug("DOWNLOADING " + app.PackageName + " FROM F-DROID")
-	if app.Android.Version[ver].Arch[arch].Url != "" {
-		index, err := getFDroidRepoIndex(app.Android.Version[ver].Arch[arch].Url)
+	if !d.cacheEnabled() {
+		tmp, err := d.fetchMirrors(ctx, src, mirrors, filepath.Dir(dest), sums)
 		if err != nil {
-			return fmt.Errorf("Error while downloading %v from %v:\n  %v", app.PackageName,
-				app.Android.Version[ver].Arch[arch].Url, err)
+			return err
 		}
-		// Read contents of index file and parse XML for desired info
-		bytes, err := ioutil.ReadFile(index)
+		err = os.Rename(tmp, dest)
 		if err != nil {
-			return fmt.Errorf("Error while reading F-Droid index from %v:\n  %v",
-				app.Android.Version[ver].Arch[arch].Url, err)
+			return fmt.Errorf("Error while moving temporary file from %v to %v:\n  %v", tmp, dest, err)
 		}
+		return nil
+	}
 
-		var repoInfo FDroidRepo
-		err = xml.Unmarshal(bytes, &repoInfo)
-		if err != nil {
-			return fmt.Errorf("Error while parsing XML from %v:\n  %v",
-				app.Android.Version[ver].Arch[arch].Url, err)
-		}
+	// Mirrors serve the same file, so it is cached under the original URL
+	key := cacheKey(src, sums)
+	unlock := lockKey(key)
+	defer unlock()
 
-		// Navigate parsed XML for information on the desired package
-		for _, tmpapp := range repoInfo.Apps {
-			if tmpapp.Id == app.PackageName {
-				lib.Debug("ADDING PERMISSIONS LISTED ON F-DROID")
-				app.Permissions = strings.Split(tmpapp.Apks[0].Permissions, ",")
-				for _, ver := range zip.Versions {
-					if app.Android.Version[ver] != nil && app.Android.Version[ver].Base != "" {
-						if app.Android.Version[ver].HasArchSpecificInfo {
-							for _, arch := range zip.Arches {
-								file := app.Android.Version[ver].Arch[arch]
-								switch tmpapp.Apks[0].Hash.Type {
-								case "md5":
-									file.MD5 = tmpapp.Apks[0].Hash.Hash
-								case "sha1":
-									file.SHA1 = tmpapp.Apks[0].Hash.Hash
-								case "sha256":
-									file.SHA256 = tmpapp.Apks[0].Hash.Hash
-								}
-								app.Android.Version[ver].Arch[arch] = file
-							}
-						} else {
-							file := app.Android.Version[ver].Arch[lib.NOARCH]
-							switch tmpapp.Apks[0].Hash.Type {
-							case "md5":
-								file.MD5 = tmpapp.Apks[0].Hash.Hash
-							case "sha1":
-								file.SHA1 = tmpapp.Apks[0].Hash.Hash
-							case "sha256":
-								file.SHA256 = tmpapp.Apks[0].Hash.Hash
-							}
-							app.Android.Version[ver].Arch[lib.NOARCH] = file
-						}
-					}
-				}
-				// Download file and store file locations
-				err := Download(app.Android.Version[ver].Arch[arch].Url+"/"+tmpapp.Apks[0].FileName, dest)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	if cached := d.lookupCache(key, sums, false); cached != "" {
+		fmt.Println("Using cached copy of " + src)
+		return copyFile(cached, dest)
+	}
+
+	tmpDir := filepath.Join(d.opts.CacheDir, "tmp")
+	err := os.MkdirAll(tmpDir, os.ModeDir|0755)
+	if err != nil {
+		return fmt.Errorf("Error while creating directory %v:\n  %v", tmpDir, err)
+	}
+
+	tmp, err := d.fetchMirrors(ctx, src, mirrors, tmpDir, sums)
+	if err != nil {
+		return err
+	}
+
+	blob, err := d.storeCache(key, src, sums, tmp)
+	if err != nil {
+		// Hand the file over anyway so the caller's checksum verification
+		// reports the problem the same way it does without a cache
+		lib.Debug("NOT CACHING " + src + ": " + err.Error())
+		defer os.Remove(tmp)
+		return copyFile(tmp, dest)
 	}
-	return nil
+	return copyFile(blob, dest)
 }
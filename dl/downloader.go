@@ -0,0 +1,79 @@
+package dl
+
+import (
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Options control where a Downloader looks for files and how it downloads
+// them. Zero values use the defaults.
+type Options struct {
+	CacheDir    string        // Where downloads are cached, empty to not cache them
+	CacheMaxAge time.Duration // How long to reuse cached files without checksums, 0 for forever
+	Offline     bool          // Only use the cache and VendorDir, never the network
+	VendorDir   string        // Pre-downloaded files to use in offline mode
+	TempDir     string        // Where F-Droid indexes are downloaded to, the system default if empty
+	Jobs        int           // Downloads to run at once, the number of CPUs by default
+	JobsPerHost int           // Downloads from one host to run at once, 2 by default
+	Timeout     time.Duration // For connecting, responding and each read, 30 seconds by default
+	Retries     int           // Retries of temporary failures, 3 by default and none if negative
+	RetryDelay  time.Duration // Before the first retry, doubled for each one after it, 1 second by default
+}
+
+// Downloader downloads apps, files and F-Droid indexes. Each Downloader has
+// its own limits and remembers the F-Droid indexes it read, so builds with
+// different options can run in one process.
+type Downloader struct {
+	opts   Options
+	client *http.Client
+
+	jobSlots  lib.Semaphore
+	hostSlots map[string]lib.Semaphore
+	hostMux   sync.Mutex
+
+	// Parsed indexes, so each repository is only read once
+	fdroidIndexes    map[string]FDroidIndex
+	fdroidIndexesMux sync.Mutex
+
+	// Files that could not be found in offline mode
+	missing    map[string]bool
+	missingMux sync.Mutex
+}
+
+func New(opts Options) *Downloader {
+	if opts.Jobs < 1 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	if opts.JobsPerHost < 1 {
+		opts.JobsPerHost = defaultJobsPerHost
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultRetryDelay
+	}
+
+	// There is no overall timeout since large APKs take a while on slow
+	// connections, stalled transfers are caught by fetchOnce instead
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: opts.Timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = opts.Timeout
+	transport.ResponseHeaderTimeout = opts.Timeout
+
+	return &Downloader{
+		opts:          opts,
+		client:        &http.Client{Transport: transport},
+		jobSlots:      lib.NewSemaphore(opts.Jobs),
+		hostSlots:     make(map[string]lib.Semaphore),
+		fdroidIndexes: make(map[string]FDroidIndex),
+		missing:       make(map[string]bool)}
+}
@@ -0,0 +1,601 @@
+package dl
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// F-Droid repositories publish their index in up to three formats: the legacy
+// index.xml, index-v1.json (inside index-v1.jar) and index-v2.json (described
+// by entry.json). Every format is parsed into an FDroidIndex so the rest of
+// the build does not care which one a repository uses.
+
+const (
+	FDroidIndexAuto = "auto"
+	FDroidIndexXML  = "xml"
+	FDroidIndexV1   = "v1"
+	FDroidIndexV2   = "v2"
+)
+
+// FDroidIndexFormats lists the formats tried by FDroidIndexAuto, in order
+var FDroidIndexFormats = []string{FDroidIndexV2, FDroidIndexV1, FDroidIndexXML}
+
+// FDroidPackage is a single APK listed in an F-Droid repository
+type FDroidPackage struct {
+	ApkName     string
+	VersionName string
+	VersionCode int
+	MinSdk      int
+	MaxSdk      int
+	NativeCode  []string
+	Hash        lib.Checksums
+	Permissions []string
+}
+
+// FDroidIndex maps package names to their APKs, newest first
+type FDroidIndex map[string][]FDroidPackage
+
+func (index FDroidIndex) sort() {
+	for _, pkgs := range index {
+		sort.SliceStable(pkgs, func(i, j int) bool {
+			return pkgs[i].VersionCode > pkgs[j].VersionCode
+		})
+	}
+}
+
+func hashOfType(hashType, hash string) lib.Checksums {
+	switch strings.ToLower(hashType) {
+	case "md5":
+		return lib.Checksums{MD5: hash}
+	case "sha1":
+		return lib.Checksums{SHA1: hash}
+	case "sha256":
+		return lib.Checksums{SHA256: hash}
+	}
+	return lib.Checksums{}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+ * index.xml
+ */
+
+type FDroidHash struct {
+	Type string `xml:"type,attr"`
+	Hash string `xml:",chardata"`
+}
+
+type FDroidApk struct {
+	Version     string     `xml:"version"`
+	VersionCode int        `xml:"versioncode"`
+	FileName    string     `xml:"apkname"`
+	Hash        FDroidHash `xml:"hash"`
+	MinSdk      int        `xml:"sdkver"`
+	MaxSdk      int        `xml:"maxsdkver"`
+	NativeCode  string     `xml:"nativecode"`
+	Permissions string     `xml:"permissions"`
+}
+
+type FDroidApp struct {
+	Id   string      `xml:"id,attr"`
+	Name string      `xml:"name"`
+	Apks []FDroidApk `xml:"package"`
+}
+
+type FDroidRepo struct {
+	XMLName xml.Name    `xml:"fdroid"`
+	Apps    []FDroidApp `xml:"application"`
+}
+
+func parseFDroidXML(data []byte) (FDroidIndex, error) {
+	var repo FDroidRepo
+	err := xml.Unmarshal(data, &repo)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing index.xml:\n  %v", err)
+	}
+
+	index := make(FDroidIndex)
+	for _, app := range repo.Apps {
+		for _, apk := range app.Apks {
+			index[app.Id] = append(index[app.Id], FDroidPackage{
+				ApkName:     apk.FileName,
+				VersionName: apk.Version,
+				VersionCode: apk.VersionCode,
+				MinSdk:      apk.MinSdk,
+				MaxSdk:      apk.MaxSdk,
+				NativeCode:  splitList(apk.NativeCode),
+				Hash:        hashOfType(apk.Hash.Type, apk.Hash.Hash),
+				Permissions: splitList(apk.Permissions)})
+		}
+	}
+	return index, nil
+}
+
+/*
+ * index-v1.json
+ */
+
+// fdroidInt accepts numbers that some repositories publish as strings.
+// Values that are not numbers at all, like SDK codenames, become 0.
+type fdroidInt int
+
+func (i *fdroidInt) UnmarshalJSON(data []byte) error {
+	n, err := strconv.Atoi(strings.Trim(string(data), "\""))
+	if err != nil {
+		n = 0
+	}
+	*i = fdroidInt(n)
+	return nil
+}
+
+type fdroidV1Package struct {
+	ApkName          string          `json:"apkName"`
+	Hash             string          `json:"hash"`
+	HashType         string          `json:"hashType"`
+	VersionName      string          `json:"versionName"`
+	VersionCode      fdroidInt       `json:"versionCode"`
+	MinSdk           fdroidInt       `json:"minSdkVersion"`
+	MaxSdk           fdroidInt       `json:"maxSdkVersion"`
+	NativeCode       []string        `json:"nativecode"`
+	UsesPermission   [][]interface{} `json:"uses-permission"`
+	UsesPermission23 [][]interface{} `json:"uses-permission-sdk-23"`
+}
+
+type fdroidV1Index struct {
+	Packages map[string][]fdroidV1Package `json:"packages"`
+}
+
+func parseFDroidV1(data []byte) (FDroidIndex, error) {
+	var repo fdroidV1Index
+	err := json.Unmarshal(data, &repo)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing index-v1.json:\n  %v", err)
+	}
+
+	index := make(FDroidIndex)
+	for name, pkgs := range repo.Packages {
+		for _, pkg := range pkgs {
+			var perms []string
+			// Each permission is a [name, maxSdkVersion] pair
+			for _, perm := range append(pkg.UsesPermission, pkg.UsesPermission23...) {
+				if len(perm) > 0 {
+					if str, ok := perm[0].(string); ok {
+						perms = append(perms, str)
+					}
+				}
+			}
+			index[name] = append(index[name], FDroidPackage{
+				ApkName:     pkg.ApkName,
+				VersionName: pkg.VersionName,
+				VersionCode: int(pkg.VersionCode),
+				MinSdk:      int(pkg.MinSdk),
+				MaxSdk:      int(pkg.MaxSdk),
+				NativeCode:  pkg.NativeCode,
+				Hash:        hashOfType(pkg.HashType, pkg.Hash),
+				Permissions: perms})
+		}
+	}
+	return index, nil
+}
+
+/*
+ * entry.json and index-v2.json
+ */
+
+type fdroidV2Entry struct {
+	Index struct {
+		Name   string `json:"name"`
+		SHA256 string `json:"sha256"`
+	} `json:"index"`
+}
+
+type fdroidV2Permission struct {
+	Name string `json:"name"`
+}
+
+type fdroidV2Version struct {
+	File struct {
+		Name   string `json:"name"`
+		SHA256 string `json:"sha256"`
+	} `json:"file"`
+	Manifest struct {
+		VersionName string    `json:"versionName"`
+		VersionCode fdroidInt `json:"versionCode"`
+		UsesSdk     struct {
+			MinSdk fdroidInt `json:"minSdkVersion"`
+		} `json:"usesSdk"`
+		MaxSdk           fdroidInt            `json:"maxSdkVersion"`
+		NativeCode       []string             `json:"nativecode"`
+		UsesPermission   []fdroidV2Permission `json:"usesPermission"`
+		UsesPermission23 []fdroidV2Permission `json:"usesPermissionSdk23"`
+	} `json:"manifest"`
+}
+
+type fdroidV2Index struct {
+	Packages map[string]struct {
+		Versions map[string]fdroidV2Version `json:"versions"`
+	} `json:"packages"`
+}
+
+func parseFDroidV2Entry(data []byte) (string, string, error) {
+	var entry fdroidV2Entry
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return "", "", fmt.Errorf("Error while parsing entry.json:\n  %v", err)
+	}
+	if entry.Index.Name == "" || entry.Index.SHA256 == "" {
+		return "", "", fmt.Errorf("entry.json does not describe an index")
+	}
+	return entry.Index.Name, entry.Index.SHA256, nil
+}
+
+func parseFDroidV2(data []byte) (FDroidIndex, error) {
+	var repo fdroidV2Index
+	err := json.Unmarshal(data, &repo)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing index-v2.json:\n  %v", err)
+	}
+
+	index := make(FDroidIndex)
+	for name, pkg := range repo.Packages {
+		for _, version := range pkg.Versions {
+			var perms []string
+			for _, perm := range append(version.Manifest.UsesPermission, version.Manifest.UsesPermission23...) {
+				perms = append(perms, perm.Name)
+			}
+			index[name] = append(index[name], FDroidPackage{
+				ApkName:     strings.TrimPrefix(version.File.Name, "/"),
+				VersionName: version.Manifest.VersionName,
+				VersionCode: int(version.Manifest.VersionCode),
+				MinSdk:      int(version.Manifest.UsesSdk.MinSdk),
+				MaxSdk:      int(version.Manifest.MaxSdk),
+				NativeCode:  version.Manifest.NativeCode,
+				Hash:        lib.Checksums{SHA256: version.File.SHA256},
+				Permissions: perms})
+		}
+	}
+	return index, nil
+}
+
+/*
+ * Fetching
+ */
+
+// readRepoFile downloads a file from a repository, or one of its mirrors, and
+// returns its contents
+func (d *Downloader) readRepoFile(ctx context.Context, repo string, mirrors []string, name string, sums lib.Checksums) ([]byte, error) {
+	tmp, err := ioutil.TempFile(d.opts.TempDir, "zip-builder-fdroid-")
+	if err != nil {
+		return nil, fmt.Errorf("Error while creating a temporary file:\n  %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = d.download(ctx, strings.TrimSuffix(repo, "/")+"/"+strings.TrimPrefix(name, "/"), tmp.Name(), sums,
+		mirrorUrls(mirrors, name)...)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %v:\n  %v", tmp.Name(), err)
+	}
+	return data, nil
+}
+
+// readJarEntry returns the contents of a single file inside a JAR
+func readJarEntry(data []byte, name string) ([]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening JAR:\n  %v", err)
+	}
+	for _, file := range reader.File {
+		if file.Name == name {
+			rc, err := file.Open()
+			if err != nil {
+				return nil, fmt.Errorf("Error while opening %v inside JAR:\n  %v", name, err)
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+	}
+	return nil, fmt.Errorf("JAR does not contain %v", name)
+}
+
+// readSignedJarEntry verifies that a JAR was signed by the certificate with
+// the given fingerprint and returns the contents of one of its files
+func readSignedJarEntry(data []byte, name, fingerprint string) ([]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening JAR:\n  %v", err)
+	}
+	certs, err := jar.Verify(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error while verifying JAR signature:\n  %v", err)
+	}
+	for _, cert := range certs {
+		if jar.Fingerprint(cert) != jar.NormalizeFingerprint(fingerprint) {
+			return nil, fmt.Errorf("Index is signed by a certificate with fingerprint %v, expected %v",
+				jar.Fingerprint(cert), jar.NormalizeFingerprint(fingerprint))
+		}
+	}
+	return readJarEntry(data, name)
+}
+
+// fetchFDroidIndex downloads and parses one index format. With a fingerprint,
+// only the signed form of the index is used and its signature must match.
+func (d *Downloader) fetchFDroidIndex(ctx context.Context, repo string, mirrors []string, format, fingerprint string) (FDroidIndex, error) {
+	switch format {
+	case FDroidIndexXML:
+		var data []byte
+		var err error
+		if fingerprint == "" {
+			data, err = d.readRepoFile(ctx, repo, mirrors, "index.xml", lib.Checksums{})
+		} else {
+			data, err = d.readRepoFile(ctx, repo, mirrors, "index.jar", lib.Checksums{})
+			if err == nil {
+				data, err = readSignedJarEntry(data, "index.xml", fingerprint)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseFDroidXML(data)
+	case FDroidIndexV1:
+		data, err := d.readRepoFile(ctx, repo, mirrors, "index-v1.jar", lib.Checksums{})
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint == "" {
+			data, err = readJarEntry(data, "index-v1.json")
+		} else {
+			data, err = readSignedJarEntry(data, "index-v1.json", fingerprint)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseFDroidV1(data)
+	case FDroidIndexV2:
+		var entry []byte
+		var err error
+		if fingerprint == "" {
+			entry, err = d.readRepoFile(ctx, repo, mirrors, "entry.json", lib.Checksums{})
+		} else {
+			entry, err = d.readRepoFile(ctx, repo, mirrors, "entry.jar", lib.Checksums{})
+			if err == nil {
+				entry, err = readSignedJarEntry(entry, "entry.json", fingerprint)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The entry is signed and pins the checksum of the actual index
+		name, sum, err := parseFDroidV2Entry(entry)
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.readRepoFile(ctx, repo, mirrors, name, lib.Checksums{SHA256: sum})
+		if err != nil {
+			return nil, err
+		}
+		return parseFDroidV2(data)
+	}
+	return nil, fmt.Errorf("Unknown F-Droid index format: %v", format)
+}
+
+// getFDroidRepoIndex returns the parsed index of the repository at repo or
+// one of its mirrors, which must serve the same index. With
+// FDroidIndexAuto, each format is tried until one works. If fingerprint is
+// set, the index must be signed by the matching certificate.
+func (d *Downloader) getFDroidRepoIndex(ctx context.Context, repo string, mirrors []string, format, fingerprint string) (FDroidIndex, error) {
+	if format == "" {
+		format = FDroidIndexAuto
+	}
+	key := "fdroid\n" + repo + "\n" + format + "\n" + jar.NormalizeFingerprint(fingerprint)
+	unlock := lockKey(key)
+	defer unlock()
+
+	d.fdroidIndexesMux.Lock()
+	index, ok := d.fdroidIndexes[key]
+	d.fdroidIndexesMux.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	formats := []string{format}
+	if format == FDroidIndexAuto {
+		formats = FDroidIndexFormats
+	}
+
+	var errs []string
+	var offlineUrls []string
+	var err error
+	for _, f := range formats {
+		lib.Debug("TRYING F-DROID INDEX FORMAT " + f + " FOR " + repo)
+		index, err = d.fetchFDroidIndex(ctx, repo, mirrors, f, fingerprint)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if offline, ok := err.(*offlineError); ok {
+			offlineUrls = append(offlineUrls, offline.Url)
+		}
+		errs = append(errs, f+": "+err.Error())
+	}
+	if err != nil {
+		// Only report missing offline files once nothing else could be used
+		for _, src := range offlineUrls {
+			d.recordMissing(src)
+		}
+		return nil, fmt.Errorf("Could not read any F-Droid index from %v:\n  %v", repo, strings.Join(errs, "\n  "))
+	}
+
+	index.sort()
+	d.fdroidIndexesMux.Lock()
+	d.fdroidIndexes[key] = index
+	d.fdroidIndexesMux.Unlock()
+	return index, nil
+}
+
+// abiRank returns how well a package's native code suits arch: 0 for the
+// preferred ABI, higher for fallbacks and -1 if it cannot run at all.
+// Packages without native code run everywhere.
+func abiRank(pkg FDroidPackage, arch string) int {
+	if len(pkg.NativeCode) == 0 {
+		return 0
+	}
+	for rank, abi := range lib.ArchABIs[arch] {
+		for _, native := range pkg.NativeCode {
+			if native == abi {
+				return rank
+			}
+		}
+	}
+	return -1
+}
+
+// selectFDroidPackage picks the newest APK that installs on SDK levels
+// minSdk through maxSdk and runs on every one of arches, honoring the
+// version pins on file
+func selectFDroidPackage(pkgs []FDroidPackage, file *lib.FileInfo, minSdk, maxSdk int, arches []string) (FDroidPackage, error) {
+	var best FDroidPackage
+	bestRank := -1
+	for _, pkg := range pkgs {
+		if file.Version != "" && pkg.VersionName != file.Version {
+			continue
+		}
+		if file.VersionCode != 0 && pkg.VersionCode != file.VersionCode {
+			continue
+		}
+		if pkg.MinSdk > minSdk || (pkg.MaxSdk != 0 && pkg.MaxSdk < maxSdk) {
+			lib.Debug(fmt.Sprintf("SKIPPING %v (%v): SDK %v-%v", pkg.ApkName, pkg.VersionCode, pkg.MinSdk, pkg.MaxSdk))
+			continue
+		}
+		rank := 0
+		for _, arch := range arches {
+			archRank := abiRank(pkg, arch)
+			if archRank < 0 {
+				rank = -1
+				break
+			}
+			rank += archRank
+		}
+		if rank < 0 {
+			lib.Debug(fmt.Sprintf("SKIPPING %v (%v): NATIVE CODE %v", pkg.ApkName, pkg.VersionCode, pkg.NativeCode))
+			continue
+		}
+		// Packages are sorted newest first, so only a better ABI match of the
+		// same version can replace the first match
+		if bestRank < 0 || (pkg.VersionCode == best.VersionCode && rank < bestRank) {
+			best = pkg
+			bestRank = rank
+		}
+	}
+
+	if bestRank < 0 {
+		pins := ""
+		if file.Version != "" {
+			pins += " with version " + file.Version
+		}
+		if file.VersionCode != 0 {
+			pins += fmt.Sprintf(" with version code %v", file.VersionCode)
+		}
+		return best, fmt.Errorf("No APK%v supports SDK %v through %v on %v", pins, minSdk, maxSdk, strings.Join(arches, ", "))
+	}
+	return best, nil
+}
+
+// ResolveFDroidPackage picks the APK of app to install on Android version ver
+// and arch of zip from the F-Droid repository at file.Url and returns it with
+// its URL. versions gives the API levels of the versions of zip. The
+// repository index comes from the cache when possible, so this also works
+// offline.
+func (d *Downloader) ResolveFDroidPackage(ctx context.Context, versions *lib.VersionTable, app *lib.AppInfo, zip *lib.ZipInfo, file *lib.FileInfo, ver, arch string) (FDroidPackage, string, error) {
+	index, err := d.getFDroidRepoIndex(ctx, file.Url, file.Mirrors, app.FDroidIndex, app.FDroidFingerprint)
+	if err != nil {
+		return FDroidPackage{}, "", fmt.Errorf("Error while reading the index of %v:\n  %w", file.Url, err)
+	}
+
+	pkgs := index[app.PackageName]
+	if len(pkgs) == 0 {
+		return FDroidPackage{}, "", fmt.Errorf("%v is not available in the F-Droid repository at %v", app.PackageName, file.Url)
+	}
+
+	// The APK is installed on this version and every later one in the zip
+	// that shares its configuration
+	minSdk := versions.SdkLevel(ver)
+	maxSdk := minSdk
+	for _, v := range zip.Versions {
+		if app.Android.Version[v] != nil && app.Android.Version[v].Base == ver && versions.SdkLevel(v) > maxSdk {
+			maxSdk = versions.SdkLevel(v)
+		}
+	}
+	arches := []string{arch}
+	if arch == lib.NOARCH {
+		arches = zip.Arches
+	}
+
+	pkg, err := selectFDroidPackage(pkgs, file, minSdk, maxSdk, arches)
+	if err != nil {
+		return FDroidPackage{}, "", fmt.Errorf("Error while choosing an APK of %v from %v:\n  %v", app.PackageName, file.Url, err)
+	}
+	return pkg, strings.TrimSuffix(file.Url, "/") + "/" + pkg.ApkName, nil
+}
+
+// ResolveFDroidApk resolves the APK of app like ResolveFDroidPackage does.
+// Where to download it from, its version, permissions and checksums are
+// filled into file, which must be the copy of one zip and not the shared
+// configuration.
+func (d *Downloader) ResolveFDroidApk(ctx context.Context, versions *lib.VersionTable, app *lib.AppInfo, zip *lib.ZipInfo, file *lib.FileInfo, ver, arch string) error {
+	lib.Debug("RESOLVING " + app.PackageName + " FROM F-DROID")
+	if file.Url == "" {
+		return nil
+	}
+
+	pkg, url, err := d.ResolveFDroidPackage(ctx, versions, app, zip, file, ver, arch)
+	if err != nil {
+		return fmt.Errorf("Error while resolving %v:\n  %w", app.PackageName, err)
+	}
+	fmt.Printf("Selected %v %v (%v) for Android %v on %v\n", app.PackageName, pkg.VersionName, pkg.VersionCode, ver, arch)
+
+	file.ResolvedVersion = pkg.VersionName
+	file.ResolvedVersionCode = pkg.VersionCode
+	file.Permissions = pkg.Permissions
+	// Record the checksum so the download gets verified
+	if pkg.Hash.MD5 != "" {
+		file.MD5 = pkg.Hash.MD5
+	}
+	if pkg.Hash.SHA1 != "" {
+		file.SHA1 = pkg.Hash.SHA1
+	}
+	if pkg.Hash.SHA256 != "" {
+		file.SHA256 = pkg.Hash.SHA256
+	}
+
+	file.ResolvedUrl = url
+	file.ResolvedMirrors = mirrorUrls(file.Mirrors, pkg.ApkName)
+	return nil
+}
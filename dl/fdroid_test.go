@@ -0,0 +1,34 @@
+package dl
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// The fingerprint of the key that signed ../jar/testdata/signed.jar
+const signedJarFingerprint = "F4:2A:7D:78:CC:33:AE:CD:76:96:A4:37:EF:6F:22:5D:C7:11:75:11:90:BE:91:77:5D:E4:A9:2D:D2:80:6D:4A"
+
+func TestReadSignedJarEntry(t *testing.T) {
+	data, err := ioutil.ReadFile("../jar/testdata/signed.jar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := readSignedJarEntry(data, "index-v1.json", signedJarFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(index), "Test Repo") {
+		t.Errorf("unexpected index contents: %q", index)
+	}
+
+	wrong := strings.Replace(signedJarFingerprint, "F4", "F5", 1)
+	_, err = readSignedJarEntry(data, "index-v1.json", wrong)
+	if err == nil {
+		t.Fatal("JAR signed by another key was accepted")
+	}
+	if !strings.Contains(err.Error(), "expected f52a7d78") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
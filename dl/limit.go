@@ -0,0 +1,45 @@
+package dl
+
+import (
+	"context"
+	"net/url"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Downloads are limited both overall, by Options.Jobs, and per host, by
+// Options.JobsPerHost, so mirrors do not rate limit us
+const defaultJobsPerHost = 2
+
+func (d *Downloader) hostSemaphore(host string) lib.Semaphore {
+	d.hostMux.Lock()
+	defer d.hostMux.Unlock()
+	if d.hostSlots[host] == nil {
+		d.hostSlots[host] = lib.NewSemaphore(d.opts.JobsPerHost)
+	}
+	return d.hostSlots[host]
+}
+
+// acquireDownload waits until src may be downloaded and returns the function
+// that frees its slots again
+func (d *Downloader) acquireDownload(ctx context.Context, src string) (func(), error) {
+	host := src
+	if u, err := url.Parse(src); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	hostSlot := d.hostSemaphore(host)
+
+	// Taking the host slot first keeps downloads waiting on a busy host from
+	// blocking downloads from other hosts
+	if err := hostSlot.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := d.jobSlots.Acquire(ctx); err != nil {
+		hostSlot.Release()
+		return nil, err
+	}
+	return func() {
+		d.jobSlots.Release()
+		hostSlot.Release()
+	}, nil
+}
@@ -0,0 +1,100 @@
+package dl
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// In offline mode every download must be satisfied by the cache or by a
+// vendored copy. Vendored files are looked up as <VendorDir>/<host>/<path>
+// first and then as <VendorDir>/<file name>, so a directory can either mirror
+// the upstream layout or just hold the files.
+
+// offlineError is returned when a file is neither cached nor vendored
+type offlineError struct {
+	Url string
+}
+
+func (e *offlineError) Error() string {
+	return e.Url + " is not available offline: it is neither cached nor vendored"
+}
+
+func (d *Downloader) recordMissing(src string) {
+	d.missingMux.Lock()
+	d.missing[src] = true
+	d.missingMux.Unlock()
+}
+
+// MissingArtifacts lists every URL that could not be resolved in offline mode
+func (d *Downloader) MissingArtifacts() []string {
+	d.missingMux.Lock()
+	defer d.missingMux.Unlock()
+	var urls []string
+	for src := range d.missing {
+		urls = append(urls, src)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// findVendored returns the path of a vendored copy of src that satisfies
+// sums, or "" if there is none
+func (d *Downloader) findVendored(src string, sums lib.Checksums) string {
+	dir := d.opts.VendorDir
+	if dir == "" {
+		return ""
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return ""
+	}
+
+	candidates := []string{
+		filepath.Join(dir, u.Host, filepath.FromSlash(u.Path)),
+		filepath.Join(dir, path.Base(u.Path))}
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		actual, err := hashFile(candidate)
+		if err != nil {
+			lib.Debug("COULD NOT READ VENDORED FILE " + candidate + ": " + err.Error())
+			continue
+		}
+		if !matchesChecksums(sums, actual) {
+			fmt.Println("WARNING: Vendored file " + candidate + " does not match the checksums configured for " + src)
+			continue
+		}
+		return candidate
+	}
+	return ""
+}
+
+// resolveOffline copies a cached or vendored copy of src to dest without
+// touching the network
+func (d *Downloader) resolveOffline(src, dest string, sums lib.Checksums) error {
+	if d.cacheEnabled() {
+		key := cacheKey(src, sums)
+		unlock := lockKey(key)
+		cached := d.lookupCache(key, sums, true)
+		unlock()
+		if cached != "" {
+			fmt.Println("Using cached copy of " + src)
+			return copyFile(cached, dest)
+		}
+	}
+
+	if vendored := d.findVendored(src, sums); vendored != "" {
+		fmt.Println("Using vendored copy of " + src)
+		return copyFile(vendored, dest)
+	}
+
+	return &offlineError{Url: src}
+}
@@ -0,0 +1,212 @@
+package dl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+// Downloads are retried with exponential backoff when the connection fails,
+// stalls or the server answers 429 or 5xx. A retry continues from where the
+// last attempt stopped if the server supports Range requests. Options.Timeout,
+// Options.Retries and Options.RetryDelay control this.
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultRetries    = 3
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = 30 * time.Second
+)
+
+// retryDelay is how long to wait before retry number attempt, counting from 0
+func (d *Downloader) retryDelay(attempt int) time.Duration {
+	delay := d.opts.RetryDelay
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// retryableError is a failure that may go away when trying again
+type retryableError struct {
+	err        error
+	retryAfter time.Duration // Requested by the server, 0 if not
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// stallReader cancels a transfer when no data arrives for a while
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+	wait  time.Duration
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.wait)
+	}
+	return n, err
+}
+
+// retryAfter reads the Retry-After header, which is only understood in its
+// number of seconds form
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// fetchOnce makes one attempt at downloading src into out. If out already has
+// data from an earlier attempt, only the rest is requested. validator is the
+// ETag or Last-Modified of the first response, so a changed file is not
+// resumed with the wrong data.
+func (d *Downloader) fetchOnce(ctx context.Context, src string, out *os.File, validator *string) error {
+	// Without a validator, resuming could mix two versions of the file
+	if *validator == "" {
+		err := out.Truncate(0)
+		if err != nil {
+			return fmt.Errorf("Error while truncating the file at %v:\n  %v", out.Name(), err)
+		}
+	}
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("Error while reading the file at %v:\n  %v", out.Name(), err)
+	}
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, src, nil)
+	if err != nil {
+		return fmt.Errorf("Error while creating a request for %v:\n  %v", src, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", *validator)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Error while setting up a connection to %v:\n  %w", src, err)
+		}
+		return &retryableError{err: fmt.Errorf("Error while setting up a connection to %v:\n  %v", src, err)}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			out.Truncate(0)
+			return &retryableError{err: fmt.Errorf("Error while resuming %v:\n  Received unexpected range %v",
+				src, resp.Header.Get("Content-Range"))}
+		}
+		lib.Debug(fmt.Sprintf("RESUMING %v AT %v", src, offset))
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// The server sent the whole file, either because it does not support
+		// ranges or because the file changed
+		if offset > 0 {
+			lib.Debug("RESTARTING " + src)
+			err = out.Truncate(0)
+			if err == nil {
+				_, err = out.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				return fmt.Errorf("Error while truncating the file at %v:\n  %v", out.Name(), err)
+			}
+		}
+		*validator = resp.Header.Get("ETag")
+		if *validator == "" || strings.HasPrefix(*validator, "W/") {
+			// Weak ETags cannot be used to resume
+			*validator = resp.Header.Get("Last-Modified")
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		out.Truncate(0)
+		return &retryableError{err: fmt.Errorf("Error while resuming %v:\n  The server cannot resume at byte %v", src, offset)}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &retryableError{
+			err:        fmt.Errorf("Error while connecting to %v:\n  Received non-ok status code %v", src, resp.StatusCode),
+			retryAfter: retryAfter(resp)}
+	default:
+		return fmt.Errorf("Error while connecting to %v:\n  Received non-ok status code %v", src, resp.StatusCode)
+	}
+
+	wait := d.opts.Timeout
+	timer := time.AfterFunc(wait, cancel)
+	defer timer.Stop()
+	_, err = io.Copy(out, &stallReader{r: resp.Body, timer: timer, wait: wait})
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Error while downloading %v:\n  %w", src, ctx.Err())
+		}
+		if attemptCtx.Err() != nil {
+			err = fmt.Errorf("No data received for %v", wait)
+		}
+		return &retryableError{err: fmt.Errorf("Error while downloading %v:\n  %v", src, err)}
+	}
+	return nil
+}
+
+// fetch downloads src into a new temporary file inside dir and returns its
+// path. Cancelling ctx aborts the request.
+func (d *Downloader) fetch(ctx context.Context, src, dir string) (string, error) {
+	if d.opts.Offline {
+		return "", fmt.Errorf("Refusing to download %v: network access is disabled in offline mode", src)
+	}
+
+	release, err := d.acquireDownload(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("Error while waiting to download %v:\n  %w", src, err)
+	}
+	defer release()
+
+	out, err := ioutil.TempFile(dir, "zip-builder-")
+	if err != nil {
+		return "", fmt.Errorf("Error while creating a temporary file in %v:\n  %v", dir, err)
+	}
+	defer out.Close()
+
+	var validator string
+	for attempt := 0; ; attempt++ {
+		err = d.fetchOnce(ctx, src, out, &validator)
+		if err == nil {
+			return out.Name(), nil
+		}
+
+		retry, ok := err.(*retryableError)
+		if !ok || attempt >= d.opts.Retries {
+			os.Remove(out.Name())
+			return "", err
+		}
+		delay := d.retryDelay(attempt)
+		if retry.retryAfter > delay {
+			delay = retry.retryAfter
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+		fmt.Printf("Retrying %v in %v after error:\n  %v\n", src, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			os.Remove(out.Name())
+			return "", fmt.Errorf("Error while downloading %v:\n  %w", src, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package dl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+const testContent = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// testServer serves requests with the handler for the number of the request,
+// counting from 0, and remembers the requests it received
+type testServer struct {
+	*httptest.Server
+	mux      sync.Mutex
+	requests []*http.Request
+}
+
+func newTestServer(t *testing.T, handler func(n int, w http.ResponseWriter, r *http.Request)) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		n := len(s.requests)
+		s.requests = append(s.requests, r)
+		s.mux.Unlock()
+		handler(n, w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) request(n int) *http.Request {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if n >= len(s.requests) {
+		return nil
+	}
+	return s.requests[n]
+}
+
+func (s *testServer) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.requests)
+}
+
+func newTestDownloader() *Downloader {
+	return New(Options{Timeout: 5 * time.Second, Retries: 3, RetryDelay: 10 * time.Millisecond})
+}
+
+// download downloads src into a temporary folder and returns what was saved
+func download(t *testing.T, d *Downloader, ctx context.Context, src string, sums lib.Checksums, mirrors ...string) (string, error) {
+	dest := filepath.Join(t.TempDir(), "download")
+	err := d.Download(ctx, src, dest, sums, mirrors...)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Error while reading the download: %v", err)
+	}
+	return string(data), nil
+}
+
+// dropMidBody sends the headers and the first half of testContent, then drops
+// the connection
+func dropMidBody(w http.ResponseWriter) {
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(testContent[:len(testContent)/2]))
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func TestRetryServerError(t *testing.T) {
+	server := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testContent))
+	})
+
+	data, err := download(t, newTestDownloader(), context.Background(), server.URL, lib.Checksums{})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data != testContent {
+		t.Errorf("Downloaded %q, expected %q", data, testContent)
+	}
+	if server.count() != 2 {
+		t.Errorf("Server received %v requests, expected 2", server.count())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 0 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(testContent))
+	})
+
+	start := time.Now()
+	data, err := download(t, newTestDownloader(), context.Background(), server.URL, lib.Checksums{})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data != testContent {
+		t.Errorf("Downloaded %q, expected %q", data, testContent)
+	}
+	// The retry delay is much shorter, so only Retry-After explains the wait
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retried after %v, expected Retry-After to delay it by a second", elapsed)
+	}
+}
+
+func TestRetryResume(t *testing.T) {
+	half := len(testContent) / 2
+	server := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 0 {
+			dropMidBody(w)
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(testContent)-1, len(testContent)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(testContent[half:]))
+	})
+
+	data, err := download(t, newTestDownloader(), context.Background(), server.URL, lib.Checksums{})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data != testContent {
+		t.Errorf("Downloaded %q, expected %q", data, testContent)
+	}
+	resumed := server.request(1)
+	if resumed == nil {
+		t.Fatalf("The download was not retried")
+	}
+	if got, want := resumed.Header.Get("Range"), fmt.Sprintf("bytes=%d-", half); got != want {
+		t.Errorf("Resumed with Range %q, expected %q", got, want)
+	}
+	if got := resumed.Header.Get("If-Range"); got != `"v1"` {
+		t.Errorf("Resumed with If-Range %q, expected the ETag of the first response", got)
+	}
+}
+
+func TestRetryRangeIgnored(t *testing.T) {
+	server := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 0 {
+			dropMidBody(w)
+		}
+		// The whole file, as sent by servers without range support or when
+		// the file changed
+		w.Write([]byte(testContent))
+	})
+
+	data, err := download(t, newTestDownloader(), context.Background(), server.URL, lib.Checksums{})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data != testContent {
+		t.Errorf("Downloaded %q, expected the file to restart as %q", data, testContent)
+	}
+}
+
+func TestRetryRangeNotSatisfiable(t *testing.T) {
+	server := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		switch {
+		case n == 0:
+			dropMidBody(w)
+		case r.Header.Get("Range") != "":
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			w.Write([]byte(testContent))
+		}
+	})
+
+	data, err := download(t, newTestDownloader(), context.Background(), server.URL, lib.Checksums{})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data != testContent {
+		t.Errorf("Downloaded %q, expected %q", data, testContent)
+	}
+	if server.count() != 3 {
+		t.Errorf("Server received %v requests, expected 3", server.count())
+	}
+	if restarted := server.request(2); restarted != nil && restarted.Header.Get("Range") != "" {
+		t.Errorf("Restarted with Range %q, expected the whole file", restarted.Header.Get("Range"))
+	}
+}
+
+func TestMirrorOnWrongChecksum(t *testing.T) {
+	primary := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not the file"))
+	})
+	mirror := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testContent))
+	})
+	sum := sha256.Sum256([]byte(testContent))
+
+	data, err := download(t, newTestDownloader(), context.Background(), primary.URL,
+		lib.Checksums{SHA256: hex.EncodeToString(sum[:])}, mirror.URL)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data != testContent {
+		t.Errorf("Downloaded %q, expected the mirror's %q", data, testContent)
+	}
+	if primary.count() != 1 || mirror.count() != 1 {
+		t.Errorf("Primary received %v requests and mirror %v, expected 1 each", primary.count(), mirror.count())
+	}
+}
+
+func TestCancelDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := newTestServer(t, func(n int, w http.ResponseWriter, r *http.Request) {
+		// Cancelled once the response has arrived and the retry is waiting
+		time.AfterFunc(100*time.Millisecond, cancel)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	d := New(Options{Timeout: 5 * time.Second, Retries: 3, RetryDelay: time.Minute})
+
+	start := time.Now()
+	_, err := download(t, d, ctx, server.URL, lib.Checksums{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Download returned %v, expected it to be cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Download took %v to notice the cancellation", elapsed)
+	}
+	if server.count() != 1 {
+		t.Errorf("Server received %v requests, expected no retries after cancelling", server.count())
+	}
+}
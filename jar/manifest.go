@@ -0,0 +1,114 @@
+package jar
+
+import (
+	"bytes"
+	"crypto"
+	"strings"
+)
+
+// Section is one block of a JAR manifest or signature file. Raw holds the
+// exact bytes of the section, including the blank line ending it, because
+// signature files contain digests of those bytes.
+type Section struct {
+	Name       string
+	Attributes map[string]string
+	Raw        []byte
+}
+
+// Manifest is a parsed MANIFEST.MF or .SF file
+type Manifest struct {
+	Main     Section
+	Sections map[string]Section
+	Order    []string
+	Raw      []byte
+}
+
+// ParseManifest splits a manifest into its main section and named sections
+func ParseManifest(data []byte) *Manifest {
+	manifest := &Manifest{Sections: make(map[string]Section), Raw: data}
+
+	first := true
+	start := 0
+	var lines []string
+	pos := 0
+	for pos <= len(data) {
+		end := bytes.IndexByte(data[pos:], '\n')
+		var line []byte
+		next := len(data) + 1
+		if end < 0 {
+			line = data[pos:]
+		} else {
+			line = data[pos : pos+end]
+			next = pos + end + 1
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) == 0 || end < 0 {
+			if len(line) > 0 {
+				lines = append(lines, string(line))
+			}
+			if len(lines) > 0 || first {
+				stop := next
+				if stop > len(data) {
+					stop = len(data)
+				}
+				section := parseSection(lines, data[start:stop])
+				if first {
+					manifest.Main = section
+					first = false
+				} else if section.Name != "" {
+					manifest.Sections[section.Name] = section
+					manifest.Order = append(manifest.Order, section.Name)
+				}
+			}
+			lines = nil
+			start = next
+		} else if line[0] == ' ' && len(lines) > 0 {
+			// Continuation of a line longer than 72 bytes
+			lines[len(lines)-1] += string(line[1:])
+		} else {
+			lines = append(lines, string(line))
+		}
+		pos = next
+	}
+	return manifest
+}
+
+func parseSection(lines []string, raw []byte) Section {
+	section := Section{Attributes: make(map[string]string), Raw: raw}
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if strings.EqualFold(key, "Name") {
+			section.Name = value
+		}
+		section.Attributes[strings.ToUpper(key)] = value
+	}
+	return section
+}
+
+var digestNames = []struct {
+	Name string
+	Hash crypto.Hash
+}{
+	{"SHA-512", crypto.SHA512},
+	{"SHA-384", crypto.SHA384},
+	{"SHA-256", crypto.SHA256},
+	{"SHA1", crypto.SHA1},
+	{"SHA-1", crypto.SHA1},
+}
+
+// Digest returns the strongest digest in the section whose attribute name
+// ends with suffix, e.g. "-Digest" or "-Digest-Manifest"
+func (s Section) Digest(suffix string) (crypto.Hash, string, bool) {
+	for _, d := range digestNames {
+		if value, ok := s.Attributes[strings.ToUpper(d.Name+suffix)]; ok {
+			return d.Hash, value, true
+		}
+	}
+	return 0, "", false
+}
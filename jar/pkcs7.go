@@ -0,0 +1,276 @@
+package jar
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// Only the parts of PKCS #7 (RFC 2315) used by JAR and OTA signatures are
+// supported: detached SignedData with one or more signers, and creating it
+// with a single signer.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// SignedData is a parsed PKCS #7 signature
+type SignedData struct {
+	Certificates []*x509.Certificate
+	Content      []byte // Empty for detached signatures
+	signers      []signerInfo
+}
+
+// ParsePKCS7 parses a DER-encoded PKCS #7 SignedData structure
+func ParsePKCS7(der []byte) (*SignedData, error) {
+	var info contentInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing PKCS #7 content info:\n  %v", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("PKCS #7 content is %v, not signed data", info.ContentType)
+	}
+
+	var sd signedData
+	_, err = asn1.Unmarshal(info.Content.Bytes, &sd)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing PKCS #7 signed data:\n  %v", err)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing PKCS #7 certificates:\n  %v", err)
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, fmt.Errorf("PKCS #7 signed data has no signers")
+	}
+
+	var content []byte
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		var octets []byte
+		_, err = asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &octets)
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing PKCS #7 content:\n  %v", err)
+		}
+		content = octets
+	}
+
+	return &SignedData{Certificates: certs, Content: content, signers: sd.SignerInfos}, nil
+}
+
+func hashForOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("Unsupported digest algorithm %v", oid)
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// CheckSignature verifies a PKCS #1 v1.5, ECDSA or DSA signature over data.
+// Unlike x509.Certificate.CheckSignature this still accepts SHA-1, which older
+// JAR signatures (including many F-Droid repositories) rely on.
+func CheckSignature(pub crypto.PublicKey, hash crypto.Hash, data, sig []byte) error {
+	hashed := digest(hash, data)
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, hashed, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, hashed, sig) {
+			return fmt.Errorf("ECDSA verification failure")
+		}
+		return nil
+	case *dsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		_, err := asn1.Unmarshal(sig, &rs)
+		if err != nil {
+			return fmt.Errorf("Error while parsing DSA signature:\n  %v", err)
+		}
+		// DSA signs the leftmost bits of the digest, at most the size of Q
+		if n := pub.Q.BitLen() / 8; n < len(hashed) {
+			hashed = hashed[:n]
+		}
+		if !dsa.Verify(pub, hashed, rs.R, rs.S) {
+			return fmt.Errorf("DSA verification failure")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported public key type %T", pub)
+}
+
+func (sd *SignedData) signerCertificate(signer signerInfo) (*x509.Certificate, error) {
+	for _, cert := range sd.Certificates {
+		if bytes.Equal(cert.RawIssuer, signer.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(signer.IssuerAndSerialNumber.SerialNumber) == 0 {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("No certificate found for signer with serial number %v", signer.IssuerAndSerialNumber.SerialNumber)
+}
+
+// Verify checks every signature over content, or over the embedded content if
+// content is nil, and returns the certificates of the signers. Certificate
+// chains are not checked: Android signing certificates are self-signed and
+// trusted by pinning them, not by a CA.
+func (sd *SignedData) Verify(content []byte) ([]*x509.Certificate, error) {
+	if content == nil {
+		content = sd.Content
+	}
+
+	var certs []*x509.Certificate
+	for _, signer := range sd.signers {
+		cert, err := sd.signerCertificate(signer)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hashForOID(signer.DigestAlgorithm.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		signed := content
+		if len(signer.AuthenticatedAttributes.FullBytes) > 0 {
+			// The signature covers the attributes, which must include the
+			// digest of the content. They are signed as a SET, not with the
+			// implicit [0] tag they are stored with.
+			signed = append([]byte{0x31}, signer.AuthenticatedAttributes.FullBytes[1:]...)
+			var attrs []attribute
+			_, err = asn1.UnmarshalWithParams(signed, &attrs, "set")
+			if err != nil {
+				return nil, fmt.Errorf("Error while parsing PKCS #7 authenticated attributes:\n  %v", err)
+			}
+			var expected []byte
+			for _, attr := range attrs {
+				if attr.Type.Equal(oidMessageDigest) && len(attr.Values) == 1 {
+					_, err = asn1.Unmarshal(attr.Values[0].FullBytes, &expected)
+					if err != nil {
+						return nil, fmt.Errorf("Error while parsing PKCS #7 message digest:\n  %v", err)
+					}
+				}
+			}
+			if !bytes.Equal(expected, digest(hash, content)) {
+				return nil, fmt.Errorf("PKCS #7 message digest does not match the signed content")
+			}
+		}
+
+		err = CheckSignature(cert.PublicKey, hash, signed, signer.EncryptedDigest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signature by %v:\n  %v", cert.Subject, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// SignPKCS7 creates a detached PKCS #7 signature with SHA-256 over content
+// with the given digest. Like signapk, the digest is signed directly, without
+// authenticated attributes, which is the only form recoveries can verify.
+func SignPKCS7(contentDigest []byte, key crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+	var sigAlgorithm pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T, expected RSA or EC", key.Public())
+	}
+
+	sig, err := key.Sign(rand.Reader, contentDigest, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("Error while signing:\n  %v", err)
+	}
+
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber},
+			DigestAlgorithm:           digestAlgorithm,
+			DigestEncryptionAlgorithm: sigAlgorithm,
+			EncryptedDigest:           sig}}})
+	if err != nil {
+		return nil, fmt.Errorf("Error while encoding PKCS #7 signed data:\n  %v", err)
+	}
+
+	der, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+	if err != nil {
+		return nil, fmt.Errorf("Error while encoding PKCS #7 content info:\n  %v", err)
+	}
+	return der, nil
+}
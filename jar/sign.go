@@ -0,0 +1,129 @@
+package jar
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const createdBy = "1.0 (Android SignApk)"
+
+// writeAttribute writes a manifest line, wrapping it at 72 bytes
+func writeAttribute(buf *bytes.Buffer, name, value string) {
+	line := name + ": " + value
+	for len(line) > 72 {
+		buf.WriteString(line[:72] + "\r\n")
+		line = " " + line[72:]
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+func fileDigest(file *zip.File) (string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", fmt.Errorf("Error while opening %v:\n  %v", file.Name, err)
+	}
+	defer rc.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, rc)
+	if err != nil {
+		return "", fmt.Errorf("Error while reading %v:\n  %v", file.Name, err)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Sign copies the archive in r to w with a v1 (JAR) signature using SHA-256.
+// Like signapk, the manifest, signature file and signature block are written
+// first, followed by every other entry unchanged. Existing signatures are not
+// copied.
+func Sign(r *zip.Reader, w *zip.Writer, key crypto.Signer, cert *x509.Certificate) error {
+	// The signature files get the timestamp of the newest entry, so signing
+	// the same archive twice gives the same result
+	var modified time.Time
+	var toSign []*zip.File
+	for _, file := range r.File {
+		if file.Modified.After(modified) {
+			modified = file.Modified
+		}
+		if !isSignatureFile(file.Name) && file.Name[len(file.Name)-1] != '/' {
+			toSign = append(toSign, file)
+		}
+	}
+	sort.Slice(toSign, func(i, j int) bool { return toSign[i].Name < toSign[j].Name })
+
+	var manifest, sf bytes.Buffer
+	writeAttribute(&manifest, "Manifest-Version", "1.0")
+	writeAttribute(&manifest, "Created-By", createdBy)
+	manifest.WriteString("\r\n")
+
+	var sections bytes.Buffer
+	for _, file := range toSign {
+		digest, err := fileDigest(file)
+		if err != nil {
+			return err
+		}
+		var section bytes.Buffer
+		writeAttribute(&section, "Name", file.Name)
+		writeAttribute(&section, "SHA-256-Digest", digest)
+		section.WriteString("\r\n")
+		manifest.Write(section.Bytes())
+
+		sectionDigest := sha256.Sum256(section.Bytes())
+		writeAttribute(&sections, "Name", file.Name)
+		writeAttribute(&sections, "SHA-256-Digest", base64.StdEncoding.EncodeToString(sectionDigest[:]))
+		sections.WriteString("\r\n")
+	}
+
+	manifestDigest := sha256.Sum256(manifest.Bytes())
+	writeAttribute(&sf, "Signature-Version", "1.0")
+	writeAttribute(&sf, "Created-By", createdBy)
+	writeAttribute(&sf, "SHA-256-Digest-Manifest", base64.StdEncoding.EncodeToString(manifestDigest[:]))
+	sf.WriteString("\r\n")
+	sf.Write(sections.Bytes())
+
+	sfDigest := sha256.Sum256(sf.Bytes())
+	block, err := SignPKCS7(sfDigest[:], key, cert)
+	if err != nil {
+		return fmt.Errorf("Error while signing the signature file:\n  %v", err)
+	}
+	blockName := "META-INF/CERT.RSA"
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok {
+		blockName = "META-INF/CERT.EC"
+	}
+
+	for _, entry := range []struct {
+		Name string
+		Data []byte
+	}{
+		{manifestName, manifest.Bytes()},
+		{"META-INF/CERT.SF", sf.Bytes()},
+		{blockName, block}} {
+		writer, err := w.CreateHeader(&zip.FileHeader{Name: entry.Name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return fmt.Errorf("Error while creating %v:\n  %v", entry.Name, err)
+		}
+		_, err = writer.Write(entry.Data)
+		if err != nil {
+			return fmt.Errorf("Error while writing %v:\n  %v", entry.Name, err)
+		}
+	}
+
+	for _, file := range r.File {
+		if isSignatureFile(file.Name) {
+			continue
+		}
+		err = w.Copy(file)
+		if err != nil {
+			return fmt.Errorf("Error while copying %v:\n  %v", file.Name, err)
+		}
+	}
+	return nil
+}
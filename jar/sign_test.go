@@ -0,0 +1,75 @@
+package jar
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "zip-builder test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCertificate(t, key)
+
+	// Re-signing the fixture replaces its old signature
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	if err := Sign(openJar(t, readTestJar(t)), w, key, cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := openJar(t, buf.Bytes())
+	for _, file := range signed.File {
+		if strings.HasSuffix(file.Name, "TEST.RSA") {
+			t.Errorf("old signature %v was copied", file.Name)
+		}
+	}
+	certs, err := Verify(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(cert) {
+		t.Fatalf("signed by %v certificates, expected only the test certificate", len(certs))
+	}
+
+	tampered := rewriteJar(t, buf.Bytes(), func(name string, content []byte) []byte {
+		if name == "hello.txt" {
+			return []byte("goodbye world\n")
+		}
+		return content
+	})
+	if _, err := Verify(openJar(t, tampered)); err == nil {
+		t.Error("JAR with a changed entry verified")
+	}
+}
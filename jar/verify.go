@@ -0,0 +1,198 @@
+package jar
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+const manifestName = "META-INF/MANIFEST.MF"
+
+// Fingerprint is the SHA-256 of a certificate, in the lowercase hex form used
+// by F-Droid and apksigner
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint strips the separators and case differences people use
+// when copying fingerprints so they can be compared to Fingerprint
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "", "-", "").Replace(fingerprint))
+}
+
+// isSignatureFile reports whether name is part of the v1 signature itself,
+// and so is not listed in the manifest
+func isSignatureFile(name string) bool {
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "META-INF/") || strings.Contains(upper[len("META-INF/"):], "/") {
+		return false
+	}
+	if upper == manifestName {
+		return true
+	}
+	switch path.Ext(upper) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+func readEntry(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %v:\n  %v", file.Name, err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %v:\n  %v", file.Name, err)
+	}
+	return data, nil
+}
+
+func checkDigest(section Section, suffix string, data []byte) error {
+	hash, expected, ok := section.Digest(suffix)
+	if !ok {
+		return fmt.Errorf("no supported digest")
+	}
+	actual := base64.StdEncoding.EncodeToString(digest(hash, data))
+	if actual != expected {
+		return fmt.Errorf("%v digest is %v, expected %v", hash, actual, expected)
+	}
+	return nil
+}
+
+// verifySignatureFile checks a .SF file against the manifest
+func verifySignatureFile(sf, manifest *Manifest) error {
+	// Newer signers include a digest of the whole manifest, which covers
+	// every section at once
+	if err := checkDigest(sf.Main, "-Digest-Manifest", manifest.Raw); err == nil {
+		return nil
+	}
+
+	for _, name := range manifest.Order {
+		section, ok := sf.Sections[name]
+		if !ok {
+			return fmt.Errorf("%v is listed in the manifest but not signed", name)
+		}
+		if err := checkDigest(section, "-Digest", manifest.Sections[name].Raw); err != nil {
+			return fmt.Errorf("Manifest section for %v does not match signature file: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Verify checks the v1 (JAR) signature of an archive: every signature block
+// must be valid for its .SF file, every .SF file must match the manifest, and
+// every file in the archive must be listed in the manifest with the right
+// digest. It returns the certificate of each signer.
+func Verify(r *zip.Reader) ([]*x509.Certificate, error) {
+	entries := make(map[string]*zip.File)
+	for _, file := range r.File {
+		if _, ok := entries[file.Name]; ok {
+			return nil, fmt.Errorf("Archive contains %v more than once", file.Name)
+		}
+		entries[file.Name] = file
+	}
+
+	manifestFile, ok := entries[manifestName]
+	if !ok {
+		return nil, fmt.Errorf("Archive is not signed: %v is missing", manifestName)
+	}
+	data, err := readEntry(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	manifest := ParseManifest(data)
+
+	// Signature files, sorted so errors are reported consistently
+	var sfNames []string
+	for name := range entries {
+		if isSignatureFile(name) && strings.EqualFold(path.Ext(name), ".SF") {
+			sfNames = append(sfNames, name)
+		}
+	}
+	sort.Strings(sfNames)
+	if len(sfNames) == 0 {
+		return nil, fmt.Errorf("Archive is not signed: no signature files found")
+	}
+
+	var certs []*x509.Certificate
+	for _, sfName := range sfNames {
+		base := strings.TrimSuffix(sfName, path.Ext(sfName))
+		var block *zip.File
+		for _, ext := range []string{".RSA", ".DSA", ".EC"} {
+			for name, file := range entries {
+				if strings.EqualFold(name, base+ext) {
+					block = file
+				}
+			}
+		}
+		if block == nil {
+			return nil, fmt.Errorf("No signature block found for %v", sfName)
+		}
+
+		sfData, err := readEntry(entries[sfName])
+		if err != nil {
+			return nil, err
+		}
+		blockData, err := readEntry(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sd, err := ParsePKCS7(blockData)
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing %v:\n  %v", block.Name, err)
+		}
+		signers, err := sd.Verify(sfData)
+		if err != nil {
+			return nil, fmt.Errorf("Error while verifying %v:\n  %v", sfName, err)
+		}
+
+		err = verifySignatureFile(ParseManifest(sfData), manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Error while verifying %v:\n  %v", sfName, err)
+		}
+		certs = append(certs, signers...)
+	}
+
+	// Every file must be listed and match its digest
+	for _, file := range r.File {
+		if strings.HasSuffix(file.Name, "/") || isSignatureFile(file.Name) {
+			continue
+		}
+		section, ok := manifest.Sections[file.Name]
+		if !ok {
+			return nil, fmt.Errorf("%v is not signed", file.Name)
+		}
+		hash, expected, ok := section.Digest("-Digest")
+		if !ok {
+			return nil, fmt.Errorf("%v has no supported digest in the manifest", file.Name)
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Error while opening %v:\n  %v", file.Name, err)
+		}
+		h := hash.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error while reading %v:\n  %v", file.Name, err)
+		}
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != expected {
+			return nil, fmt.Errorf("%v does not match the digest in the manifest", file.Name)
+		}
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,132 @@
+package jar
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testdata/signed.jar was signed with openssl by a throwaway self-signed key
+const signedJarFingerprint = "f42a7d78cc33aecd7696a437ef6f225dc711751190be91775de4a92dd2806d4a"
+
+func readTestJar(t *testing.T) []byte {
+	data, err := ioutil.ReadFile("testdata/signed.jar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func openJar(t *testing.T, data []byte) *zip.Reader {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// rewriteJar copies a JAR, passing the contents of each entry through edit
+func rewriteJar(t *testing.T, data []byte, edit func(name string, content []byte) []byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, file := range openJar(t, data).File {
+		content, err := readEntry(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := w.Create(file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = out.Write(edit(file.Name, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	certs, err := Verify(openJar(t, readTestJar(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("got %v signers, expected 1", len(certs))
+	}
+	if fp := Fingerprint(certs[0]); fp != signedJarFingerprint {
+		t.Errorf("fingerprint is %v, expected %v", fp, signedJarFingerprint)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	// Flip a byte near the end of one entry: for the signature block that
+	// is the signature itself, rather than the certificate
+	flip := func(target string) func(string, []byte) []byte {
+		return func(name string, content []byte) []byte {
+			if name == target {
+				content = append([]byte(nil), content...)
+				content[len(content)-8] ^= 0x01
+			}
+			return content
+		}
+	}
+
+	tests := []struct {
+		entry string
+		err   string
+	}{
+		{"hello.txt", "does not match the digest"},
+		{"index-v1.json", "does not match the digest"},
+		{"META-INF/MANIFEST.MF", "does not match signature file"},
+		{"META-INF/TEST.SF", "Error while verifying META-INF/TEST.SF"},
+		{"META-INF/TEST.RSA", ""},
+	}
+	for _, test := range tests {
+		data := rewriteJar(t, readTestJar(t), flip(test.entry))
+		_, err := Verify(openJar(t, data))
+		if err == nil {
+			t.Errorf("%v: tampered JAR verified", test.entry)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: unexpected error: %v", test.entry, err)
+		}
+	}
+}
+
+func TestVerifyUnsignedEntry(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, file := range openJar(t, readTestJar(t)).File {
+		if err := w.Copy(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := w.Create("extra.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("not in the manifest\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Verify(openJar(t, buf.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "extra.txt is not signed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	colons := strings.ToUpper(signedJarFingerprint[:2])
+	for i := 2; i < len(signedJarFingerprint); i += 2 {
+		colons += ":" + strings.ToUpper(signedJarFingerprint[i:i+2])
+	}
+	if got := NormalizeFingerprint(colons); got != signedJarFingerprint {
+		t.Errorf("NormalizeFingerprint(%q) = %q", colons, got)
+	}
+}
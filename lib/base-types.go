@@ -3,11 +3,11 @@ package lib
 import (
 	"bytes"
 	"fmt"
-	"sync"
 )
 
 type FileInfo struct {
 	Url                string
+	Mirrors            []string // Tried in order if Url fails, for F-Droid apps these are mirrors of the repo
 	Destination        string
 	InstallRemoveFiles []string
 	UpdateRemoveFiles  []string
@@ -17,13 +17,38 @@ type FileInfo struct {
 	MD5                string
 	SHA1               string
 	SHA256             string
-	Mux                sync.RWMutex
+	Version            string // Pin to this versionName when downloading from F-Droid
+	VersionCode        int    // Pin to this versionCode when downloading from F-Droid
+	// Set when planning a zip that installs an app from an F-Droid repository
+	ResolvedUrl         string   // The APK chosen from the repository
+	ResolvedMirrors     []string // The same APK on the mirrors of the repository
+	ResolvedVersion     string
+	ResolvedVersionCode int
+	Permissions         []string // Permissions the repository lists for the APK
+}
+
+// Checksums holds the digests a downloaded file is expected to have.
+// Empty fields are not checked.
+type Checksums struct {
+	MD5    string
+	SHA1   string
+	SHA256 string
+}
+
+func (c Checksums) IsEmpty() bool {
+	return c.MD5 == "" && c.SHA1 == "" && c.SHA256 == ""
+}
+
+func (f *FileInfo) Checksums() Checksums {
+	return Checksums{MD5: f.MD5, SHA1: f.SHA1, SHA256: f.SHA256}
 }
 
 func (f *FileInfo) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("FileInfo{\n  URL: ")
 	buf.WriteString(f.Url)
+	buf.WriteString("\n  Mirrors: ")
+	buf.WriteString(fmt.Sprintf("%v", f.Mirrors))
 	buf.WriteString("\n  Destination: ")
 	buf.WriteString(f.Destination)
 	buf.WriteString("\n  InstallRemoveFiles: ")
@@ -42,6 +67,10 @@ func (f *FileInfo) String() string {
 	buf.WriteString(f.SHA1)
 	buf.WriteString("\n  SHA256: ")
 	buf.WriteString(f.SHA256)
+	buf.WriteString("\n  Version: ")
+	buf.WriteString(f.Version)
+	buf.WriteString("\n  VersionCode: ")
+	buf.WriteString(fmt.Sprintf("%v", f.VersionCode))
 	buf.WriteString("\n}")
 	return buf.String()
 }
@@ -50,7 +79,6 @@ type AndroidVersionInfo struct {
 	HasArchSpecificInfo bool   // Architectures were set in config. If false, just read from Arm
 	Base                string // Which Android version's config this was based on
 	Arch                map[string]*FileInfo
-	Mux                 sync.RWMutex
 }
 
 func (av *AndroidVersionInfo) String() string {
@@ -72,7 +100,6 @@ func (av *AndroidVersionInfo) String() string {
 
 type AndroidVersions struct {
 	Version map[string]*AndroidVersionInfo
-	Mux     sync.RWMutex
 }
 
 func (av *AndroidVersions) String() string {
@@ -91,6 +118,9 @@ func (av *AndroidVersions) String() string {
 type AppInfo struct {
 	PackageName             string
 	UrlIsFDroidRepo         bool
+	FDroidIndex             string   // Index format to read from an F-Droid repo, see dl.FDroidIndexFormats
+	FDroidFingerprint       string   // SHA-256 of the certificate the F-Droid repo index must be signed with
+	SignerSHA256            []string // SHA-256 of the certificates the APK may be signed with
 	DozeWhitelist           bool
 	DozeWhitelistExceptIdle bool
 	DataSaverWhitelist      bool
@@ -98,7 +128,7 @@ type AppInfo struct {
 	BlacklistSystemUser     bool
 	Android                 AndroidVersions
 	Permissions             []string
-	Mux                     sync.RWMutex
+	PrivilegedPermissions   []string // Granted through privapp-permissions, derived from the APK if nil
 }
 
 func (a *AppInfo) String() string {
@@ -108,6 +138,12 @@ func (a *AppInfo) String() string {
 	buf.WriteString(a.PackageName)
 	buf.WriteString("\n  UrlIsFDroidRepo: ")
 	buf.WriteString(fmt.Sprintf("%v", a.UrlIsFDroidRepo))
+	buf.WriteString("\n  FDroidIndex: ")
+	buf.WriteString(a.FDroidIndex)
+	buf.WriteString("\n  FDroidFingerprint: ")
+	buf.WriteString(a.FDroidFingerprint)
+	buf.WriteString("\n  SignerSHA256: ")
+	buf.WriteString(fmt.Sprintf("%v", a.SignerSHA256))
 	buf.WriteString("\n  DozeWhitelist: ")
 	buf.WriteString(fmt.Sprintf("%v", a.DozeWhitelist))
 	buf.WriteString("\n  DozeWhitelistExceptIdle: ")
@@ -120,6 +156,8 @@ func (a *AppInfo) String() string {
 	buf.WriteString(a.Android.String())
 	buf.WriteString("\n  Permissions: ")
 	buf.WriteString(fmt.Sprintf("%v", a.Permissions))
+	buf.WriteString("\n  PrivilegedPermissions: ")
+	buf.WriteString(fmt.Sprintf("%v", a.PrivilegedPermissions))
 	buf.WriteString("\n}")
 	return buf.String()
 }
@@ -134,7 +172,18 @@ type ZipInfo struct {
 	Files              []string
 	Arches             []string
 	Versions           []string
-	Mux                sync.RWMutex
+	UpdateBinary       string // Path to a custom update-binary, empty for the bundled one
+	UpdateBinarySHA256 string
+	Installer          string // InstallerEdify or InstallerShell
+	Output             string // OutputRecovery or OutputMagisk
+	Uninstaller        bool   // Whether to also build <Name>-uninstall.zip
+	SigningKey         string // Private key to sign the zip with, empty to not sign
+	SigningCert        string // Certificate matching SigningKey
+	ModuleId           string // The following are only used for Magisk modules
+	ModuleVersion      string
+	ModuleVersionCode  int
+	ModuleAuthor       string
+	ModuleDescription  string
 }
 
 func (z *ZipInfo) String() string {
@@ -158,22 +207,30 @@ func (z *ZipInfo) String() string {
 	buf.WriteString(fmt.Sprintf("%v", z.Arches))
 	buf.WriteString("\n  Versions: ")
 	buf.WriteString(fmt.Sprintf("%v", z.Versions))
+	buf.WriteString("\n  UpdateBinary: ")
+	buf.WriteString(z.UpdateBinary)
+	buf.WriteString("\n  UpdateBinarySHA256: ")
+	buf.WriteString(z.UpdateBinarySHA256)
+	buf.WriteString("\n  Installer: ")
+	buf.WriteString(z.Installer)
+	buf.WriteString("\n  Output: ")
+	buf.WriteString(z.Output)
+	buf.WriteString("\n  Uninstaller: ")
+	buf.WriteString(fmt.Sprintf("%v", z.Uninstaller))
+	buf.WriteString("\n  SigningKey: ")
+	buf.WriteString(z.SigningKey)
+	buf.WriteString("\n  SigningCert: ")
+	buf.WriteString(z.SigningCert)
+	buf.WriteString("\n  ModuleId: ")
+	buf.WriteString(z.ModuleId)
+	buf.WriteString("\n  ModuleVersion: ")
+	buf.WriteString(z.ModuleVersion)
+	buf.WriteString("\n  ModuleVersionCode: ")
+	buf.WriteString(fmt.Sprintf("%v", z.ModuleVersionCode))
+	buf.WriteString("\n  ModuleAuthor: ")
+	buf.WriteString(z.ModuleAuthor)
+	buf.WriteString("\n  ModuleDescription: ")
+	buf.WriteString(z.ModuleDescription)
 	buf.WriteString("\n}")
 	return buf.String()
 }
-
-func (z *ZipInfo) Lock() {
-	z.Mux.Lock()
-}
-
-func (z *ZipInfo) RLock() {
-	z.Mux.RLock()
-}
-
-func (z *ZipInfo) Unlock() {
-	z.Mux.Unlock()
-}
-
-func (z *ZipInfo) RUnlock() {
-	z.Mux.RUnlock()
-}
@@ -10,19 +10,16 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/spf13/viper"
 )
 
 var (
+	// Built-in Android versions zips can target, oldest first. Sorted by API
+	// level, not by name, so "10" comes after "9.0". Configurations add their
+	// own versions to a VersionTable, never to these.
 	Versions []string = []string{
-		/*"2.3",
-		  "4.0",
-		  "4.1",
-		  "4.2",
-		  "4.3",
-		  "4.4",*/
 		"5.0",
 		"5.1",
 		"6.0",
@@ -30,16 +27,187 @@ var (
 		"7.1",
 		"8.0",
 		"8.1",
-        "9.0"}
+		"9.0",
+		"10",
+		"11",
+		"12",
+		"12L",
+		"13",
+		"14",
+		"15"}
 	Arches []string = []string{
 		"arm",
 		"arm64",
 		"x86",
 		"x86_64"}
+	// API level of each built-in Android version
+	SdkLevels map[string]int = map[string]int{
+		"5.0": 21,
+		"5.1": 22,
+		"6.0": 23,
+		"7.0": 24,
+		"7.1": 25,
+		"8.0": 26,
+		"8.1": 27,
+		"9.0": 28,
+		"10":  29,
+		"11":  30,
+		"12":  31,
+		"12L": 32,
+		"13":  33,
+		"14":  34,
+		"15":  35}
+	// Native ABIs each architecture can run, most preferred first
+	ArchABIs map[string][]string = map[string][]string{
+		"arm":    {"armeabi-v7a", "armeabi"},
+		"arm64":  {"arm64-v8a", "armeabi-v7a", "armeabi"},
+		"x86":    {"x86"},
+		"x86_64": {"x86_64", "x86"}}
 )
 
 const NOARCH string = "noarch"
 
+// Installer backends a zip can be built with
+const (
+	// An edify updater-script run by the bundled update-binary
+	InstallerEdify string = "edify"
+	// A shell script used as update-binary
+	InstallerShell string = "shell"
+)
+
+// Kinds of zip that can be built
+const (
+	// A flashable zip installed from recovery
+	OutputRecovery string = "recovery"
+	// A systemless Magisk module
+	OutputMagisk string = "magisk"
+)
+
+// Partitions files can be installed to or removed from
+var Partitions []string = []string{
+	"/system",
+	"/system_ext",
+	"/product",
+	"/vendor",
+	"/data"}
+
+// PartitionOf returns the partition a path is on, or "" if it is not on one
+// of Partitions
+func PartitionOf(dest string) string {
+	for _, part := range Partitions {
+		if dest == part || strings.HasPrefix(dest, part+"/") {
+			return part
+		}
+	}
+	return ""
+}
+
+// IsSystemPartition reports whether a partition is read-only at runtime and
+// holds preinstalled apps and their configuration
+func IsSystemPartition(part string) bool {
+	return part != "" && part != "/data"
+}
+
+// SystemRelative returns dest relative to /system, the base path addon.d
+// scripts back files up from. Other system partitions are reached through
+// their /system/<partition> symlinks. It returns "" for paths that are not on
+// a system partition.
+func SystemRelative(dest string) string {
+	part := PartitionOf(dest)
+	if !IsSystemPartition(part) {
+		return ""
+	}
+	if part == "/system" {
+		return strings.TrimPrefix(dest[len(part):], "/")
+	}
+	return dest[1:]
+}
+
+// VersionTable is the Android versions zips can target along with their API
+// levels. Each configuration has its own table, so the versions it adds are
+// not seen by other configurations.
+type VersionTable struct {
+	Versions  []string // Oldest first
+	SdkLevels map[string]int
+}
+
+// NewVersionTable returns a table of the built-in versions
+func NewVersionTable() *VersionTable {
+	t := &VersionTable{
+		Versions:  append([]string(nil), Versions...),
+		SdkLevels: make(map[string]int)}
+	for ver, sdk := range SdkLevels {
+		t.SdkLevels[ver] = sdk
+	}
+	return t
+}
+
+// SdkLevel returns the API level of an Android version, or 0 if it is unknown
+func (t *VersionTable) SdkLevel(ver string) int {
+	return t.SdkLevels[ver]
+}
+
+// SetVersion adds an Android version to the table, or changes the API level
+// of a known one
+func (t *VersionTable) SetVersion(ver string, sdk int) {
+	ver = t.NormalizeVersion(ver)
+	if _, ok := t.SdkLevels[ver]; !ok {
+		t.Versions = append(t.Versions, ver)
+	}
+	t.SdkLevels[ver] = sdk
+	t.SortVersions(t.Versions)
+}
+
+// SortVersions sorts Android versions by API level
+func (t *VersionTable) SortVersions(vers []string) {
+	sort.SliceStable(vers, func(i, j int) bool {
+		return t.SdkLevel(vers[i]) < t.SdkLevel(vers[j])
+	})
+}
+
+// NormalizeVersion returns the name a version has in the table, so that "9"
+// and "9.0", "10.0" and "10" or "12l" and "12L" refer to the same version
+func (t *VersionTable) NormalizeVersion(ver string) string {
+	for _, name := range []string{ver, ver + ".0", strings.TrimSuffix(ver, ".0")} {
+		for known := range t.SdkLevels {
+			if strings.EqualFold(name, known) {
+				return known
+			}
+		}
+	}
+	return ver
+}
+
+// VersionOrDefault reads an Android version that may have been written as a
+// string or a number in the config
+func (t *VersionTable) VersionOrDefault(item interface{}, def string) string {
+	switch v := item.(type) {
+	case string:
+		return t.NormalizeVersion(v)
+	case int64:
+		return t.NormalizeVersion(strconv.FormatInt(v, 10))
+	case int:
+		return t.NormalizeVersion(strconv.Itoa(v))
+	case float64:
+		return t.NormalizeVersion(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return def
+}
+
+// FilterVersions returns the known versions among vers, sorted by API level
+func (t *VersionTable) FilterVersions(vers []string) []string {
+	var results []string
+	for _, ver := range t.Versions {
+		for _, v := range vers {
+			if t.NormalizeVersion(v) == ver {
+				results = append(results, ver)
+				break
+			}
+		}
+	}
+	return results
+}
+
 func StringOrDefault(item interface{}, def string) string {
 	if item != nil {
 		str, ok := item.(string)
@@ -50,6 +218,18 @@ func StringOrDefault(item interface{}, def string) string {
 	return def
 }
 
+func IntOrDefault(item interface{}, def int) int {
+	switch i := item.(type) {
+	case int:
+		return i
+	case int64:
+		return int(i)
+	case float64:
+		return int(i)
+	}
+	return def
+}
+
 func BoolOrDefault(item interface{}, def bool) bool {
 	if item != nil {
 		b, ok := item.(bool)
@@ -115,6 +295,17 @@ func StringIntersection(strs1 []string, strs2 []string) []string {
 	return results
 }
 
+// SortedKeys returns the keys of a set in order, so output generated from it
+// is the same on every build
+func SortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func GenerateMD5File(path string) error {
 	fmt.Println("Generating MD5 file for " + path)
 	text, err := GetHash(path, "md5")
@@ -156,14 +347,31 @@ func GetHash(fileToHash, algo string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
+// Output settings are shared by everything in the process, set them once
+// before building
+var (
+	debugOutput   bool
+	verboseOutput bool
+)
+
+// SetDebug enables the output of Debug, which also enables Verbose
+func SetDebug(enabled bool) {
+	debugOutput = enabled
+}
+
+// SetVerbose enables the output of Verbose
+func SetVerbose(enabled bool) {
+	verboseOutput = enabled
+}
+
 func Debug(msg string) {
-	if viper.GetBool("debug") {
+	if debugOutput {
 		fmt.Println("DEBUG: " + msg)
 	}
 }
 
 func Verbose(msg string) {
-	if viper.GetBool("verbose") || viper.GetBool("debug") {
+	if verboseOutput || debugOutput {
 		fmt.Println(msg)
 	}
 }
@@ -0,0 +1,27 @@
+package lib
+
+import "context"
+
+// Semaphore limits how many goroutines do something at once
+type Semaphore chan struct{}
+
+func NewSemaphore(n int) Semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire waits for a free slot, giving up if ctx is cancelled first
+func (s Semaphore) Acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s Semaphore) Release() {
+	<-s
+}
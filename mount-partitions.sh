@@ -0,0 +1,153 @@
+#!/system/bin/sh
+#
+# Mounts partitions read-write for zips built by zip-builder
+#
+# Usage: mount-partitions.sh mount <partition>...
+#        mount-partitions.sh unmount <partition>...
+#
+# Handles system-as-root devices, where the system partition is the root
+# filesystem and /system is a directory inside it, and dynamic partitions,
+# where system, vendor, product and system_ext are logical partitions inside
+# "super" that are read-only until their device mapper block is made writable.
+#
+
+SLOT=$(getprop ro.boot.slot_suffix 2>/dev/null)
+[ -z "$SLOT" ] && SLOT=$(getprop ro.boot.slot 2>/dev/null | sed 's/^\([ab]\)$/_\1/')
+DYNAMIC=$(getprop ro.boot.dynamic_partitions 2>/dev/null)
+
+log() {
+  echo "$@"
+}
+
+is_mounted() {
+  grep -q " $1 " /proc/mounts
+}
+
+# Prints the device a mount point is mounted from
+block_device_of() {
+  grep " $1 " /proc/mounts | tail -n 1 | cut -d ' ' -f 1
+}
+
+# Finds the block device of a partition, preferring logical partitions
+find_block() {
+  for dev in /dev/block/mapper/$1$SLOT /dev/block/mapper/$1 \
+             /dev/block/bootdevice/by-name/$1$SLOT /dev/block/bootdevice/by-name/$1 \
+             /dev/block/by-name/$1$SLOT /dev/block/by-name/$1; do
+    if [ -b "$dev" ]; then
+      echo "$dev"
+      return 0
+    fi
+  done
+  return 1
+}
+
+# Makes a mounted partition writable, which for logical partitions means the
+# block device has to be made writable first
+make_writable() {
+  dev=$(block_device_of "$1")
+  [ -n "$dev" ] && blockdev --setrw "$dev" 2>/dev/null
+  mount -o rw,remount "$1" 2>/dev/null || mount -o rw,remount "$dev" "$1" 2>/dev/null
+  is_writable "$2"
+}
+
+# Checks that files can actually be created in a directory
+is_writable() {
+  touch "$1/.zip-builder-rw" 2>/dev/null || return 1
+  rm -f "$1/.zip-builder-rw"
+}
+
+# Bind mounts the system directory of a system-as-root mount onto /system.
+# The root is made writable first, and the bind mount remounted as well, as
+# it keeps the read-only flag it was created with.
+bind_system() {
+  make_writable "$1" "$1/system" || return 1
+  is_mounted /system || mount -o bind "$1/system" /system || return 1
+  mount -o remount,rw,bind /system 2>/dev/null
+  is_writable /system
+}
+
+mount_system() {
+  # Recoveries mount system-as-root devices at /system_root or /mnt/system.
+  # Some set ANDROID_ROOT=/system with the whole partition mounted there,
+  # which is fixed up below instead.
+  for root in "$ANDROID_ROOT" /system_root /mnt/system; do
+    [ "$root" = /system ] && continue
+    if [ -n "$root" ] && is_mounted "$root" && [ -f "$root/system/build.prop" ]; then
+      bind_system "$root"
+      return $?
+    fi
+  done
+
+  is_mounted /system || mount /system 2>/dev/null
+  if ! is_mounted /system; then
+    dev=$(find_block system) || return 1
+    [ "$DYNAMIC" = "true" ] && blockdev --setrw "$dev" 2>/dev/null
+    mount -o rw "$dev" /system 2>/dev/null || mount -o ro "$dev" /system || return 1
+  fi
+
+  if [ -f /system/system/build.prop ]; then
+    # The whole system partition was mounted at /system, move it out of
+    # the way so /system points to the system directory
+    mkdir -p /system_root
+    umount /system
+    mount -o rw "$(find_block system)" /system_root 2>/dev/null || mount -o ro "$(find_block system)" /system_root || return 1
+    bind_system /system_root
+    return $?
+  fi
+  make_writable /system /system
+}
+
+mount_partition() {
+  name=${1#/}
+  [ "$name" = data ] && name=userdata
+  if [ "$1" = /system ]; then
+    mount_system
+    return $?
+  fi
+
+  is_mounted "$1" || mount "$1" 2>/dev/null
+  if ! is_mounted "$1"; then
+    dev=$(find_block "$name")
+    if [ -z "$dev" ]; then
+      # Older devices keep these as directories inside system
+      mount_system || return 1
+      [ -d "/system/$name" ] || return 1
+      mkdir -p "$1"
+      mount -o bind "/system/$name" "$1" || return 1
+      return 0
+    fi
+    mkdir -p "$1"
+    [ "$DYNAMIC" = "true" ] && blockdev --setrw "$dev" 2>/dev/null
+    mount -o rw "$dev" "$1" 2>/dev/null || mount -o ro "$dev" "$1" || return 1
+  fi
+  make_writable "$1" "$1"
+}
+
+unmount_partition() {
+  is_mounted "$1" && umount "$1"
+  if [ "$1" = /system ]; then
+    for root in /system_root /mnt/system; do
+      is_mounted "$root" && umount "$root"
+    done
+  fi
+  return 0
+}
+
+action=$1
+shift
+status=0
+for part in "$@"; do
+  case "$action" in
+    mount)
+      log "Mounting $part"
+      if ! mount_partition "$part"; then
+        log "Could not mount $part read-write"
+        status=1
+      fi
+    ;;
+    unmount)
+      unmount_partition "$part"
+    ;;
+  esac
+done
+exit $status
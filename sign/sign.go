@@ -0,0 +1,182 @@
+package sign
+
+import (
+	"archive/zip"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+)
+
+// Zips are signed the way signapk -w signs OTA packages: a v1 (JAR) signature
+// for tools that check the entries, plus a whole-file signature in the archive
+// comment, which is what recoveries verify. The whole-file signature covers
+// every byte of the archive except the comment and its length, so it has to
+// be added last.
+
+// The comment starts with this message, followed by a NUL byte, the PKCS #7
+// signature and a 6 byte footer
+const signedBy = "signed by SignApk"
+
+// footerSize is the size of the footer at the end of the comment: the offset
+// of the signature from the end of the file, 0xffff and the comment size
+const footerSize = 6
+
+// eocdMagic starts the end of central directory record
+var eocdMagic = []byte{0x50, 0x4b, 0x05, 0x06}
+
+// readPEMOrDER returns the DER bytes of a PEM file, or the file itself if it
+// is not PEM, as with the .pk8 and .x509.pem files AOSP uses
+func readPEMOrDER(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %v:\n  %v", path, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	return data, nil
+}
+
+// LoadPrivateKey reads an RSA or EC private key in PKCS #8, PKCS #1 or SEC 1
+// form, either PEM or DER encoded
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	der, err := readPEMOrDER(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("Unsupported private key type %T in %v", key, path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Could not parse %v as a private key", path)
+}
+
+// LoadCertificate reads a PEM or DER encoded X.509 certificate
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	der, err := readPEMOrDER(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing certificate %v:\n  %v", path, err)
+	}
+	return cert, nil
+}
+
+// SignZip replaces the zip at path with a signed copy
+func SignZip(path string, key crypto.Signer, cert *x509.Certificate) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("Error while opening %v:\n  %v", path, err)
+	}
+	defer reader.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("Error while creating a temporary file for %v:\n  %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := zip.NewWriter(tmp)
+	err = jar.Sign(&reader.Reader, writer, key, cert)
+	if err != nil {
+		return fmt.Errorf("Error while signing entries of %v:\n  %v", path, err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("Error while writing signed copy of %v:\n  %v", path, err)
+	}
+
+	err = signWholeFile(tmp, key, cert)
+	if err != nil {
+		return fmt.Errorf("Error while signing %v:\n  %v", path, err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("Error while writing signed copy of %v:\n  %v", path, err)
+	}
+	reader.Close()
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("Error while setting permissions of %v:\n  %v", tmp.Name(), err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("Error while replacing %v with its signed copy:\n  %v", path, err)
+	}
+	return nil
+}
+
+// signWholeFile adds the whole-file signature to an archive with an empty
+// comment, which ends with the 2 byte comment length
+func signWholeFile(file *os.File, key crypto.Signer, cert *x509.Certificate) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	signedLen := info.Size() - 2
+
+	h := sha256.New()
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(h, file, signedLen)
+	if err != nil {
+		return fmt.Errorf("Error while hashing archive:\n  %v", err)
+	}
+
+	block, err := jar.SignPKCS7(h.Sum(nil), key, cert)
+	if err != nil {
+		return err
+	}
+
+	comment := append([]byte(signedBy), 0)
+	comment = append(comment, block...)
+	totalSize := len(comment) + footerSize
+	if totalSize > 0xffff {
+		return fmt.Errorf("Signature is too large for the archive comment")
+	}
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint16(footer[0:], uint16(totalSize-len(signedBy)-1))
+	footer[2], footer[3] = 0xff, 0xff
+	binary.LittleEndian.PutUint16(footer[4:], uint16(totalSize))
+	comment = append(comment, footer...)
+
+	// Recoveries reject archives with anything that looks like another end
+	// of central directory record after the real one
+	for i := 0; i+len(eocdMagic) <= len(comment); i++ {
+		if string(comment[i:i+len(eocdMagic)]) == string(eocdMagic) {
+			return fmt.Errorf("Signature contains a spurious end of central directory record at %v", i)
+		}
+	}
+
+	trailer := make([]byte, 2, 2+len(comment))
+	binary.LittleEndian.PutUint16(trailer, uint16(totalSize))
+	trailer = append(trailer, comment...)
+	_, err = file.WriteAt(trailer, signedLen)
+	if err != nil {
+		return fmt.Errorf("Error while writing signature:\n  %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package sign
+
+import (
+	"archive/zip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair saves key and a self-signed certificate for it the way AOSP
+// stores them, as a DER PKCS #8 .pk8 and a PEM .x509.pem
+func writeKeyPair(t *testing.T, dir string, key crypto.Signer) (string, string) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "zip-builder test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "test.pk8")
+	certPath := filepath.Join(dir, "test.x509.pem")
+	if err := ioutil.WriteFile(keyPath, pk8, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, certPath
+}
+
+func writeZip(t *testing.T, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(file)
+	for _, name := range []string{
+		"META-INF/com/google/android/update-binary",
+		// Long enough to be wrapped in the manifest
+		"files/" + strings.Repeat("LongApplicationName", 5) + ".apk"} {
+		out, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write([]byte("contents of " + name))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signTestZip creates and signs a zip with key, returning its path and the
+// certificate it was signed with
+func signTestZip(t *testing.T, key crypto.Signer) (string, *x509.Certificate) {
+	dir := t.TempDir()
+	keyPath, certPath := writeKeyPair(t, dir, key)
+	loadedKey, err := LoadPrivateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadCertificate(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "test.zip")
+	writeZip(t, path)
+	if err := SignZip(path, loadedKey, cert); err != nil {
+		t.Fatal(err)
+	}
+	return path, cert
+}
+
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"RSA": rsaKey, "ECDSA": ecKey}
+}
+
+func TestSignZipRoundTrip(t *testing.T) {
+	for name, key := range testKeys(t) {
+		path, cert := signTestZip(t, key)
+		signer, err := VerifyZip(path)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !signer.Equal(cert) {
+			t.Errorf("%v: signed by %v, expected %v", name, signer.Subject, cert.Subject)
+		}
+
+		// Entries must still be readable after the comment was added
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(r.File) != 5 {
+			t.Errorf("%v: signed zip has %v entries, expected 5", name, len(r.File))
+		}
+		r.Close()
+	}
+}
+
+func TestVerifyZipTampered(t *testing.T) {
+	key := testKeys(t)["RSA"]
+	path, _ := signTestZip(t, key)
+	signed, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One byte in the first entry, one in the central directory and one in
+	// the signature itself
+	cd := strings.LastIndex(string(signed), "PK\x01\x02")
+	for _, offset := range []int{40, cd + 20, len(signed) - footerSize - 10} {
+		data := append([]byte(nil), signed...)
+		data[offset] ^= 0x01
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyZip(path); err == nil {
+			t.Errorf("zip with byte %v of %v changed verified", offset, len(data))
+		}
+	}
+}
+
+func TestVerifyZipUnsigned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unsigned.zip")
+	writeZip(t, path)
+	_, err := VerifyZip(path)
+	if err == nil || !strings.Contains(err.Error(), "no whole-file signature") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
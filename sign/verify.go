@@ -0,0 +1,71 @@
+package sign
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+)
+
+// The end of central directory record without the comment
+const eocdSize = 22
+
+// VerifyZip checks the whole-file and v1 signatures of a zip signed by SignZip
+// or signapk, and returns the certificate it was signed with
+func VerifyZip(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %v:\n  %v", path, err)
+	}
+	if len(data) < eocdSize+footerSize {
+		return nil, fmt.Errorf("%v is too small to be a signed zip", path)
+	}
+
+	footer := data[len(data)-footerSize:]
+	if footer[2] != 0xff || footer[3] != 0xff {
+		return nil, fmt.Errorf("%v has no whole-file signature", path)
+	}
+	commentSize := int(binary.LittleEndian.Uint16(footer[4:]))
+	signatureStart := int(binary.LittleEndian.Uint16(footer[0:]))
+	eocd := len(data) - commentSize - eocdSize
+	if eocd < 0 || !bytes.Equal(data[eocd:eocd+len(eocdMagic)], eocdMagic) ||
+		int(binary.LittleEndian.Uint16(data[eocd+eocdSize-2:])) != commentSize {
+		return nil, fmt.Errorf("%v has a signature footer that does not match its archive comment", path)
+	}
+	if signatureStart <= footerSize || signatureStart > commentSize {
+		return nil, fmt.Errorf("%v has an invalid signature offset %v", path, signatureStart)
+	}
+	if bytes.Contains(data[eocd+len(eocdMagic):], eocdMagic) {
+		return nil, fmt.Errorf("%v has more than one end of central directory record", path)
+	}
+
+	sd, err := jar.ParsePKCS7(data[len(data)-signatureStart : len(data)-footerSize])
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing the signature of %v:\n  %v", path, err)
+	}
+	// Everything up to the comment length is signed
+	certs, err := sd.Verify(data[:len(data)-commentSize-2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid whole-file signature on %v:\n  %v", path, err)
+	}
+	cert := certs[0]
+
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %v:\n  %v", path, err)
+	}
+	v1Certs, err := jar.Verify(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid v1 signature on %v:\n  %v", path, err)
+	}
+	for _, v1Cert := range v1Certs {
+		if !v1Cert.Equal(cert) {
+			return nil, fmt.Errorf("%v has v1 and whole-file signatures by different certificates", path)
+		}
+	}
+	return cert, nil
+}
@@ -0,0 +1,36 @@
+// Package zipbuilder holds the files from the repository root that are built
+// into the zip-builder executable.
+package zipbuilder
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+)
+
+// UpdateBinary is the edify interpreter placed at
+// META-INF/com/google/android/update-binary inside every zip.
+//
+//go:embed update-binary
+var UpdateBinary []byte
+
+// UpdateBinarySHA256 must be updated whenever update-binary is replaced.
+const UpdateBinarySHA256 = "4fe4ccc128bf187121c8fe36d5a72c186b07acc4152036190f7d9219e315ef9e"
+
+// VerifyUpdateBinary checks that the embedded update-binary is the one this
+// version of zip-builder was released with
+func VerifyUpdateBinary() error {
+	sum := sha256.Sum256(UpdateBinary)
+	if hex.EncodeToString(sum[:]) != UpdateBinarySHA256 {
+		return fmt.Errorf("Embedded update-binary has sha256sum %v, expected %v", hex.EncodeToString(sum[:]), UpdateBinarySHA256)
+	}
+	return nil
+}
+
+// MountScript mounts the partitions a zip writes to. The updater-script
+// extracts it from META-INF/com/google/android/mount-partitions.sh and runs it
+// before installing anything.
+//
+//go:embed mount-partitions.sh
+var MountScript []byte
@@ -0,0 +1,25 @@
+package main
+
+import "gitlab.com/Shadow53/zip-builder/build"
+
+func runBuild(args []string) error {
+	var flags Flags
+	fs := newFlagSet("build")
+	flags.AddConfigFlags(fs)
+	flags.AddCacheFlags(fs)
+	flags.AddTempDirFlag(fs)
+	flags.AddBuildFlags(fs)
+	failFast := fs.Bool("fail-fast", false, "Cancel the remaining zips after the first one fails")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(&flags)
+	if err != nil {
+		return err
+	}
+	opts, err := flags.Options()
+	if err != nil {
+		return err
+	}
+	opts.FailFast = *failFast
+	return runZips(build.New(opts), cfg, fs.Args(), (*build.Builder).Build)
+}
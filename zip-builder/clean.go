@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lastModified returns the newest modification time of path and everything
+// inside it. A running build keeps writing to its temporary folder.
+func lastModified(path string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files of a running build come and go while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+func runClean(args []string) error {
+	var flags Flags
+	fs := newFlagSet("clean")
+	flags.AddTempDirFlag(fs)
+	cacheDir := fs.String("cache", "", "The download cache to remove (default: the user cache directory)")
+	keepCache := fs.Bool("keep-cache", false, "Only remove temporary folders")
+	olderThan := fs.Duration("older-than", time.Hour, "Only remove temporary folders nothing was written to for this long, so running builds keep theirs")
+	fs.Parse(args)
+
+	tempDir := flags.TempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	// Builds create their temporary folders with this prefix
+	temps, err := filepath.Glob(filepath.Join(tempDir, "zip-builder-*"))
+	if err != nil {
+		return fmt.Errorf("Error while finding temporary folders:\n  %v", err)
+	}
+
+	var paths []string
+	for _, path := range temps {
+		modified, err := lastModified(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error while checking %v:\n  %v", path, err)
+		}
+		if time.Since(modified) < *olderThan {
+			fmt.Println("Keeping " + path + ", it may belong to a running build")
+			continue
+		}
+		paths = append(paths, path)
+	}
+
+	if !*keepCache {
+		if *cacheDir == "" {
+			*cacheDir, err = DefaultCacheDir()
+			if err != nil {
+				return err
+			}
+		}
+		paths = append(paths, *cacheDir)
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		fmt.Println("Removing " + path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fmt.Errorf("Error while removing %v:\n  %v", path, err)
+		}
+	}
+	return nil
+}
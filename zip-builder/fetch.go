@@ -0,0 +1,24 @@
+package main
+
+import "gitlab.com/Shadow53/zip-builder/build"
+
+func runFetch(args []string) error {
+	var flags Flags
+	fs := newFlagSet("fetch")
+	flags.AddConfigFlags(fs)
+	flags.AddCacheFlags(fs)
+	flags.AddTempDirFlag(fs)
+	failFast := fs.Bool("fail-fast", false, "Cancel the remaining zips after the first one fails")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(&flags)
+	if err != nil {
+		return err
+	}
+	opts, err := flags.Options()
+	if err != nil {
+		return err
+	}
+	opts.FailFast = *failFast
+	return runZips(build.New(opts), cfg, fs.Args(), (*build.Builder).Fetch)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"gitlab.com/Shadow53/zip-builder/build"
+	"gitlab.com/Shadow53/zip-builder/dl"
+)
+
+// Flags holds the command line options shared by the subcommands. Each
+// subcommand adds the groups of flags it uses to its own flag.FlagSet.
+type Flags struct {
+	ConfigPath  string
+	Verbose     bool
+	Debug       bool
+	Destination string
+	TempDir     string
+	CacheDir    string
+	NoCache     bool
+	CacheMaxAge time.Duration
+	Offline     bool
+	VendorDir   string
+	Force       bool
+	Jobs        int
+	JobsPerHost int
+	Timeout     time.Duration
+	Retries     int
+	RetryDelay  time.Duration
+}
+
+// AddConfigFlags adds the flags of every subcommand that reads the config
+func (f *Flags) AddConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.ConfigPath, "config", "", "Path to configuration file to use")
+	fs.BoolVar(&f.Debug, "debug", false, "Enable debugging output")
+	fs.BoolVar(&f.Verbose, "verbose", false, "Enable verbose output")
+}
+
+// AddTempDirFlag adds the flag choosing where temporary build folders go
+func (f *Flags) AddTempDirFlag(fs *flag.FlagSet) {
+	fs.StringVar(&f.TempDir, "temp-dir", "", "The folder to create temporary build folders in (default: the system temporary directory)")
+}
+
+// AddCacheFlags adds the flags controlling downloads and the download cache
+func (f *Flags) AddCacheFlags(fs *flag.FlagSet) {
+	fs.IntVar(&f.Jobs, "jobs", runtime.NumCPU(), "How many downloads and extractions to run at once")
+	fs.IntVar(&f.JobsPerHost, "jobs-per-host", 2, "How many downloads from the same server to run at once")
+	fs.DurationVar(&f.Timeout, "timeout", 30*time.Second, "How long to wait for a server to connect, respond or send more data")
+	fs.IntVar(&f.Retries, "retries", 3, "How many times to retry a download that failed for a temporary reason")
+	fs.DurationVar(&f.RetryDelay, "retry-delay", time.Second, "How long to wait before the first retry, doubled for each one after it")
+	fs.StringVar(&f.CacheDir, "cache", "", "The folder to cache downloaded files in (default: the user cache directory)")
+	fs.DurationVar(&f.CacheMaxAge, "cache-max-age", 24*time.Hour, "How long to reuse cached downloads that have no checksums configured")
+	fs.BoolVar(&f.Offline, "offline", false, "Never access the network, only use cached or vendored files")
+	fs.StringVar(&f.VendorDir, "vendor", "", "A folder of pre-downloaded files to use in offline mode")
+}
+
+// AddBuildFlags adds the flags only used when building zips
+func (f *Flags) AddBuildFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.Destination, "destination", "", "The folder to place the generated zip(s) into")
+	fs.BoolVar(&f.NoCache, "no-cache", false, "Always download files instead of using the cache")
+	fs.BoolVar(&f.Force, "force", false, "Rebuild zips even if nothing they are built from has changed")
+}
+
+// DefaultCacheDir is where downloads are cached if -cache is not used
+func DefaultCacheDir() (string, error) {
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("Error while finding the user cache directory, use -cache to set one:\n  %v", err)
+	}
+	return filepath.Join(userCache, "zip-builder"), nil
+}
+
+// Options converts the flags to the options of a Builder, making the paths
+// absolute so they do not depend on the working directory
+func (f *Flags) Options() (build.Options, error) {
+	opts := build.Options{
+		Destination: "build",
+		Force:       f.Force,
+		Jobs:        f.Jobs,
+		Download: dl.Options{
+			CacheMaxAge: f.CacheMaxAge,
+			Offline:     f.Offline,
+			Jobs:        f.Jobs,
+			JobsPerHost: f.JobsPerHost,
+			Timeout:     f.Timeout,
+			Retries:     f.Retries,
+			RetryDelay:  f.RetryDelay}}
+
+	if f.Destination != "" {
+		opts.Destination = f.Destination
+	}
+	absDest, err := filepath.Abs(opts.Destination)
+	if err != nil {
+		return opts, fmt.Errorf("Error while converting %v to an absolute path:\n  %v", opts.Destination, err)
+	}
+	opts.Destination = absDest
+
+	if f.TempDir != "" {
+		absTemp, err := filepath.Abs(f.TempDir)
+		if err != nil {
+			return opts, fmt.Errorf("Error while converting %v to an absolute path:\n  %v", f.TempDir, err)
+		}
+		opts.TempDir = absTemp
+		opts.Download.TempDir = absTemp
+	}
+
+	// Downloads are cached between runs unless disabled
+	if !f.NoCache {
+		cacheDir := f.CacheDir
+		if cacheDir == "" {
+			cacheDir, err = DefaultCacheDir()
+			if err != nil {
+				return opts, err
+			}
+		}
+		absCache, err := filepath.Abs(cacheDir)
+		if err != nil {
+			return opts, fmt.Errorf("Error while converting %v to an absolute path:\n  %v", cacheDir, err)
+		}
+		opts.Download.CacheDir = absCache
+	}
+
+	// Zero means the default to dl, but no retries on the command line
+	if f.Retries == 0 {
+		opts.Download.Retries = -1
+	}
+
+	if f.VendorDir != "" {
+		absVendor, err := filepath.Abs(f.VendorDir)
+		if err != nil {
+			return opts, fmt.Errorf("Error while converting %v to an absolute path:\n  %v", f.VendorDir, err)
+		}
+		opts.Download.VendorDir = absVendor
+	}
+	return opts, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/Shadow53/zip-builder/sign"
+)
+
+// isScript reports whether an entry of a built zip is a script or config file
+// worth printing
+func isScript(name string) bool {
+	switch path.Base(name) {
+	case "updater-script", "update-binary", "customize.sh", "module.prop":
+		return true
+	}
+	ext := path.Ext(name)
+	return ext == ".sh" || ext == ".xml" || ext == ".prop"
+}
+
+func runInspect(args []string) error {
+	fs := newFlagSet("inspect")
+	all := fs.Bool("all", false, "Print every text file, not only scripts")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected exactly one zip to inspect")
+	}
+	zipPath := fs.Arg(0)
+
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("Error while opening %v:\n  %v", zipPath, err)
+	}
+	defer reader.Close()
+
+	fmt.Println("Contents of " + zipPath + ":")
+	for _, f := range reader.File {
+		method := "stored"
+		if f.Method == zip.Deflate {
+			method = "deflated"
+		}
+		fmt.Printf("  %v %10v %-8v %v\n", f.Mode(), f.UncompressedSize64, method, f.Name)
+	}
+
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() || !(*all || isScript(f.Name)) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Error while opening %v in %v:\n  %v", f.Name, zipPath, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("Error while reading %v in %v:\n  %v", f.Name, zipPath, err)
+		}
+		// A custom update-binary may be a compiled program
+		if !utf8.Valid(data) || strings.ContainsRune(string(data), 0) {
+			continue
+		}
+		fmt.Printf("\n===== %v =====\n%v", f.Name, string(data))
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			fmt.Println()
+		}
+	}
+
+	fmt.Println()
+	cert, err := sign.VerifyZip(zipPath)
+	if err != nil {
+		fmt.Printf("Not signed, or the signature is invalid:\n  %v\n", err)
+	} else {
+		fmt.Println("Signed by: " + cert.Subject.String())
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"gitlab.com/Shadow53/zip-builder/dl"
+	"gitlab.com/Shadow53/zip-builder/lib"
+)
+
+func runList(args []string) error {
+	var flags Flags
+	fs := newFlagSet("list")
+	flags.AddConfigFlags(fs)
+	flags.AddCacheFlags(fs)
+	flags.AddTempDirFlag(fs)
+	fs.Parse(args)
+
+	cfg, err := loadConfig(&flags)
+	if err != nil {
+		return err
+	}
+	selected, err := cfg.SelectZips(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	// F-Droid apps are resolved the way building them would
+	opts, err := flags.Options()
+	if err != nil {
+		return err
+	}
+	downloader := dl.New(opts.Download)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	apps, files := cfg.Apps, cfg.Files
+	for _, zip := range selected {
+		output := zip.Output
+		if output != lib.OutputMagisk {
+			output += ", " + zip.Installer + " installer"
+		}
+		fmt.Printf("%v (%v)\n", zip.Name, output)
+		fmt.Printf("  Android versions: %v\n", zip.Versions)
+		fmt.Printf("  Arches: %v\n", zip.Arches)
+
+		for _, app := range zip.Apps {
+			if !apps.AppExists(app) {
+				fmt.Printf("  app %v: not defined\n", app)
+				continue
+			}
+			fmt.Printf("  app %v (%v)\n", app, apps.GetApp(app).PackageName)
+			if apps.GetApp(app).UrlIsFDroidRepo {
+				listFDroidSources(ctx, downloader, cfg.Versions, apps.GetApp(app), zip)
+			} else {
+				listSources(apps.GetApp(app).Android.Version, zip)
+			}
+		}
+		for _, file := range zip.Files {
+			if !files.FileExists(file) {
+				fmt.Printf("  file %v: not defined\n", file)
+				continue
+			}
+			fmt.Printf("  file %v\n", file)
+			listSources(files.GetFile(file).Version, zip)
+		}
+	}
+	return nil
+}
+
+// listSources prints where an app or file comes from on each Android version
+// and architecture of the zip
+func listSources(item map[string]*lib.AndroidVersionInfo, zip *lib.ZipInfo) {
+	for _, ver := range zip.Versions {
+		if item[ver] == nil {
+			fmt.Printf("    %v: not installed\n", ver)
+			continue
+		}
+		base := ""
+		if item[ver].Base != ver {
+			base = " (from " + item[ver].Base + ")"
+		}
+		for _, arch := range append([]string{lib.NOARCH}, zip.Arches...) {
+			file := item[ver].Arch[arch]
+			if file == nil {
+				continue
+			}
+			src := file.Url
+			if src == "" {
+				src = "generated"
+			}
+			if len(file.Mirrors) > 0 {
+				src += fmt.Sprintf(" (mirrors: %v)", strings.Join(file.Mirrors, ", "))
+			}
+			fmt.Printf("    %v/%v%v: %v -> %v\n", ver, arch, base, src, file.Destination)
+		}
+	}
+}
+
+// listFDroidSources prints which APK of an F-Droid app is installed on each
+// Android version and architecture of the zip
+func listFDroidSources(ctx context.Context, downloader *dl.Downloader, versions *lib.VersionTable, app *lib.AppInfo, zip *lib.ZipInfo) {
+	for _, ver := range zip.Versions {
+		if app.Android.Version[ver] == nil {
+			fmt.Printf("    %v: not installed\n", ver)
+			continue
+		}
+		base := ""
+		if app.Android.Version[ver].Base != ver {
+			base = " (from " + app.Android.Version[ver].Base + ")"
+		}
+		for _, arch := range append([]string{lib.NOARCH}, zip.Arches...) {
+			file := app.Android.Version[ver].Arch[arch]
+			if file == nil {
+				continue
+			}
+			if file.Url == "" {
+				fmt.Printf("    %v/%v%v: generated -> %v\n", ver, arch, base, file.Destination)
+				continue
+			}
+			// Resolve the shared base version, as building does
+			resolveVer := app.Android.Version[ver].Base
+			if app.Android.Version[resolveVer] == nil || app.Android.Version[resolveVer].Arch[arch] == nil {
+				resolveVer = ver
+			}
+			pkg, url, err := downloader.ResolveFDroidPackage(ctx, versions, app, zip,
+				app.Android.Version[resolveVer].Arch[arch], resolveVer, arch)
+			if err != nil {
+				fmt.Printf("    %v/%v%v: %v unresolved (%v) -> %v\n", ver, arch, base, file.Url,
+					strings.Replace(err.Error(), "\n  ", " ", -1), file.Destination)
+				continue
+			}
+			fmt.Printf("    %v/%v%v: %v (versionCode %v) -> %v\n", ver, arch, base, url, pkg.VersionCode, file.Destination)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func runValidate(args []string) error {
+	var flags Flags
+	fs := newFlagSet("validate")
+	flags.AddConfigFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := loadConfig(&flags)
+	if err != nil {
+		return err
+	}
+
+	errs := cfg.Validate()
+	if len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return fmt.Errorf("The configuration is invalid:\n  %v", strings.Join(msgs, "\n  "))
+	}
+
+	fmt.Printf("Configuration is valid: %v zip(s), %v app(s), %v file(s)\n", len(cfg.Zips), len(cfg.Apps.App), len(cfg.Files.File))
+	return nil
+}
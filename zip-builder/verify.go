@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	"gitlab.com/Shadow53/zip-builder/jar"
+	"gitlab.com/Shadow53/zip-builder/sign"
+)
+
+func runVerify(args []string) error {
+	fs := newFlagSet("verify")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected exactly one zip to verify")
+	}
+	path := fs.Arg(0)
+
+	cert, err := sign.VerifyZip(path)
+	if err != nil {
+		return fmt.Errorf("Signature verification failed:\n  %v", err)
+	}
+	fmt.Println("Signature verified for " + path)
+	fmt.Println("Signed by: " + cert.Subject.String())
+	fmt.Println("Certificate SHA-256: " + jar.Fingerprint(cert))
+	return nil
+}
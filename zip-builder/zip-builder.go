@@ -1,118 +1,167 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
+	"text/tabwriter"
 
-	"github.com/spf13/viper"
 	"gitlab.com/Shadow53/zip-builder/build"
 	"gitlab.com/Shadow53/zip-builder/config"
 	"gitlab.com/Shadow53/zip-builder/lib"
 )
 
-func main() {
-	var destination string
-	var configPath string
-	var verbose bool
-	var debug bool
-	config.InitFlags(&destination, &configPath, &verbose, &debug)
-	flag.Parse()
-
-	viper.SetDefault("destination", "./build/")
-	// All config files must be called "build"...
-	if configPath == "" {
-		viper.SetConfigName("build")
-		viper.AddConfigPath(".")
-	} else {
-		lastSep := strings.LastIndex(configPath, "/") + 1
-		path := configPath[:lastSep]
-		file := configPath[lastSep:strings.LastIndex(configPath, ".")]
-		viper.SetConfigName(file)
-		viper.AddConfigPath(path)
-	}
+// command is a subcommand of zip-builder
+type command struct {
+	Name        string
+	Args        string // Shown after the flags in the usage
+	Description string
+	Run         func(args []string) error
+}
 
-	err := viper.ReadInConfig()
+var commands []command
+
+func init() {
+	commands = []command{
+		{"build", "[zip...]", "Build the given zips, or every zip in the config", runBuild},
+		{"validate", "", "Check the configuration without downloading anything", runValidate},
+		{"list", "[zip...]", "Show zips, their apps and files and where each version and arch comes from", runList},
+		{"fetch", "[zip...]", "Download everything the given zips need into the cache", runFetch},
+		{"inspect", "<zip file>", "Show the contents and scripts of a built zip", runInspect},
+		{"verify", "<zip file>", "Check the signatures of a signed zip", runVerify},
+		{"clean", "", "Remove temporary folders and the download cache", runClean},
+	}
+}
 
-	if err != nil {
-		fmt.Printf("Error while reading the configuration file:\n  %v\n", err)
-		os.Exit(1)
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: zip-builder <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", cmd.Name, cmd.Description)
 	}
+	fmt.Fprintln(os.Stderr, "\nRun \"zip-builder <command> -h\" for the flags of a command.")
+	fmt.Fprintln(os.Stderr, "Without a command, zip-builder builds every zip.")
+}
 
-	if destination != "" {
-		viper.Set("destination", destination)
+func main() {
+	args := os.Args[1:]
+	// Older versions had no subcommands, so flags alone still mean build
+	name := "build"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
 	}
 
-	if debug {
-		viper.Set("debug", true)
+	if name == "help" {
+		usage()
+		return
 	}
 
-	if verbose {
-		viper.Set("verbose", true)
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			err := cmd.Run(args)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
 
-	// Create temporary directory, use this
-	dir, tmpErr := ioutil.TempDir("", "zip-builder-")
-	//defer os.RemoveAll(dir)
-	viper.Set("tempdir", dir)
+	fmt.Fprintf(os.Stderr, "Unknown command %v\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	if tmpErr != nil {
-		fmt.Printf("Error while creating a temporary directory:\n  %v\n", tmpErr)
-		os.Exit(1)
+// newFlagSet creates the flag set of a subcommand
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.Name == name {
+				fmt.Fprintf(fs.Output(), "Usage: zip-builder %v [flags] %v\n\n%v\n\nFlags:\n", name, cmd.Args, cmd.Description)
+			}
+		}
+		fs.PrintDefaults()
 	}
+	return fs
+}
 
-	absDest, err := filepath.Abs(viper.GetString("destination"))
-	if err != nil {
-		fmt.Printf("Error while converting %v to an absolute path:\n  %v\n", viper.GetString("destination"), err)
-		os.Exit(1)
-	}
-	viper.Set("destination", absDest)
+// loadConfig applies the output flags and loads the configuration to memory
+func loadConfig(flags *Flags) (*config.Config, error) {
+	lib.SetDebug(flags.Debug)
+	lib.SetVerbose(flags.Verbose)
 
-	// Load configuration to memory
-	zips, apps, files, err := config.MakeConfig()
+	cfg, err := config.Load(flags.ConfigPath)
 	if err != nil {
-		fmt.Printf("Error occurred while building configuration:\n  %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	if viper.GetBool("debug") {
+	if flags.Debug {
 		lib.Debug("Configuration (parsed):\n")
-		for _, zip := range zips {
+		for _, zip := range cfg.Zips {
 			lib.Debug(zip.String())
 		}
-		lib.Debug(files.String())
-		lib.Debug(apps.String())
+		lib.Debug(cfg.Files.String())
+		lib.Debug(cfg.Apps.String())
 	}
+	return cfg, nil
+}
 
-	// Build each zip
-	var wg sync.WaitGroup
-	ch := make(chan error)
-	for _, zip := range zips {
-		wg.Add(1)
-		go func(zip lib.ZipInfo, apps *lib.Apps, files *lib.Files, wg *sync.WaitGroup, ch chan error) {
-			defer wg.Done()
-			if zip.Name != "" {
-				build.MakeZip(&zip, apps, files, ch)
-			}
-		}(zip, apps, files, &wg, ch)
+// runZips builds or fetches the zips named in names with run, then prints the
+// errors of each zip and a summary. Ctrl-C cancels every zip, and a second
+// Ctrl-C exits immediately.
+func runZips(builder *build.Builder, cfg *config.Config, names []string,
+	run func(*build.Builder, context.Context, *config.Config, []string) ([]build.Result, error)) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	results, err := run(builder, ctx, cfg, names)
+	if err != nil {
+		return err
 	}
 
-	var errs []error
-	go func(ch *chan error, errs *[]error) {
-		for err := range *ch {
-			fmt.Println(err)
-			*errs = append(*errs, err)
+	failed, cancelled := 0, 0
+	for _, result := range results {
+		if result.Status == build.StatusCancelled {
+			cancelled++
 		}
-	}(&ch, &errs)
+		if result.Status != build.StatusFailed {
+			continue
+		}
+		failed++
+		fmt.Printf("\n%v failed:\n", result.Zip)
+		for _, err := range result.Errors {
+			fmt.Printf("%v\n", err)
+		}
+	}
 
-	wg.Wait()
-	close(ch)
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZIP\tSTATUS\tERRORS")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", result.Zip, result.Status, len(result.Errors))
+	}
+	tw.Flush()
 
-	for _, err := range errs {
-		fmt.Printf("\n%v\n", err)
+	if missing := builder.MissingArtifacts(); len(missing) > 0 {
+		return fmt.Errorf("\nThe following files are needed but are not cached or vendored:\n  %v",
+			strings.Join(missing, "\n  "))
+	}
+	if failed > 0 {
+		return fmt.Errorf("\n%v of %v zip(s) failed", failed, len(results))
+	}
+	// An interrupted build did not produce everything it was asked to
+	if cancelled > 0 || ctx.Err() != nil {
+		return fmt.Errorf("\nInterrupted, %v of %v zip(s) were cancelled", cancelled, len(results))
 	}
+	return nil
 }